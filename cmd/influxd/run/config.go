@@ -159,6 +159,14 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	if err := c.Retention.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.HTTPD.Validate(); err != nil {
+		return err
+	}
+
 	for _, graphite := range c.GraphiteInputs {
 		if err := graphite.Validate(); err != nil {
 			return fmt.Errorf("invalid graphite config: %v", err)
@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!freebsd
+
+package run
+
+// diskUsage returns nil, as disk usage isn't reported on this platform.
+func diskUsage(path string) func() (free, total uint64) {
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build linux darwin freebsd
+
+package run
+
+import "syscall"
+
+// diskUsage returns a function reporting the free and total bytes of the
+// disk holding path. Both are zero if they can't be determined.
+func diskUsage(path string) func() (free, total uint64) {
+	return func() (free, total uint64) {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			return 0, 0
+		}
+		return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize)
+	}
+}
@@ -245,9 +245,23 @@ func (s *Server) appendRetentionPolicyService(c retention.Config) {
 	srv := retention.NewService(c)
 	srv.MetaClient = s.MetaClient
 	srv.TSDBStore = s.TSDBStore
+	srv.ShardNotFoundError = tsdb.ErrShardNotFound
+	srv.DiskUsage = diskUsage(s.config.Data.Dir)
 	s.Services = append(s.Services, srv)
+
+	if registerRetentionDebugRoutes != nil {
+		for _, svc := range s.Services {
+			if h, ok := svc.(*httpd.Service); ok {
+				registerRetentionDebugRoutes(h.Handler, srv)
+			}
+		}
+	}
 }
 
+// registerRetentionDebugRoutes registers the retention debug routes on the
+// HTTP handler. It is only set in debug builds.
+var registerRetentionDebugRoutes func(h *httpd.Handler, srv *retention.Service)
+
 func (s *Server) appendAdminService(c admin.Config) {
 	if !c.Enabled {
 		return
@@ -270,9 +284,21 @@ func (s *Server) appendHTTPDService(c httpd.Config) {
 	srv.Handler.PointsWriter = s.PointsWriter
 	srv.Handler.Version = s.buildInfo.Version
 
+	if registerPrecreatorDebugRoutes != nil {
+		for _, svc := range s.Services {
+			if p, ok := svc.(*precreator.Service); ok {
+				registerPrecreatorDebugRoutes(srv.Handler, p)
+			}
+		}
+	}
+
 	s.Services = append(s.Services, srv)
 }
 
+// registerPrecreatorDebugRoutes registers the precreator debug routes on the
+// HTTP handler. It is only set in debug builds.
+var registerPrecreatorDebugRoutes func(h *httpd.Handler, srv *precreator.Service)
+
 func (s *Server) appendCollectdService(c collectd.Config) {
 	if !c.Enabled {
 		return
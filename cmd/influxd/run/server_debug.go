@@ -0,0 +1,110 @@
+// +build debug
+
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/services/httpd"
+	"github.com/influxdata/influxdb/services/precreator"
+	"github.com/influxdata/influxdb/services/retention"
+)
+
+func init() {
+	registerRetentionDebugRoutes = func(h *httpd.Handler, srv *retention.Service) {
+		if err := h.AddRoutes(httpd.Route{
+			Name:      "debug-retention-shards",
+			Method:    "GET",
+			Pattern:   "/debug/retention/shards",
+			Gzipped:   true,
+			DebugOnly: true,
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				json.NewEncoder(w).Encode(srv.ShardStatuses())
+			},
+		}, httpd.Route{
+			Name:      "debug-retention-eta",
+			Method:    "GET",
+			Pattern:   "/debug/retention/eta",
+			DebugOnly: true,
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				eta := srv.DeletionETA()
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				json.NewEncoder(w).Encode(struct {
+					ETA     string `json:"eta"`
+					Seconds int64  `json:"seconds"`
+				}{eta.String(), int64(eta / time.Second)})
+			},
+		}); err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to register retention debug routes: %s", err))
+		}
+
+		// Lists the protected shard groups. Shard groups can be protected or
+		// unprotected by passing their IDs in the protect and unprotect
+		// parameters of a POST.
+		if err := h.AddDebugHandler("GET", "/debug/retention/protected", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(srv.ProtectedShardGroups())
+		})); err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to register retention debug route: %s", err))
+		}
+		if err := h.AddDebugHandler("POST", "/debug/retention/protected", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			protect, err := parseShardGroupIDs(r.URL.Query()["protect"])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			unprotect, err := parseShardGroupIDs(r.URL.Query()["unprotect"])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			srv.ProtectShardGroups(protect...)
+			srv.UnprotectShardGroups(unprotect...)
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(srv.ProtectedShardGroups())
+		})); err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to register retention debug route: %s", err))
+		}
+	}
+}
+
+func init() {
+	// Runs shard group precreation immediately and lists the IDs of the
+	// shard groups it created.
+	registerPrecreatorDebugRoutes = func(h *httpd.Handler, srv *precreator.Service) {
+		if err := h.AddDebugHandler("POST", "/debug/precreate", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ids, err := srv.Precreate()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if ids == nil {
+				ids = []uint64{}
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(ids)
+		})); err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to register precreator debug route: %s", err))
+		}
+	}
+}
+
+// parseShardGroupIDs parses a list of shard group IDs.
+func parseShardGroupIDs(a []string) ([]uint64, error) {
+	ids := make([]uint64, len(a))
+	for i, s := range a {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
@@ -338,8 +338,8 @@ func (e *StatementExecutor) executeDropSeriesStatement(stmt *influxql.DropSeries
 }
 
 func (e *StatementExecutor) executeDropShardStatement(stmt *influxql.DropShardStatement) error {
-	// Locally delete the shard.
-	if err := e.TSDBStore.DeleteShard(stmt.ID); err != nil {
+	// Locally delete the shard. It may not be stored on this node.
+	if err := e.TSDBStore.DeleteShard(stmt.ID); err != nil && err != tsdb.ErrShardNotFound {
 		return err
 	}
 
@@ -1,9 +1,43 @@
 package models
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
 	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 )
 
+//go:generate protoc --gogo_out=. rows.proto
+
+// ErrNoTimeColumn is returned when an operation requires a row to have a
+// "time" column and it does not.
+var ErrNoTimeColumn = errors.New("row has no time column")
+
+// ErrUnsortedTimeColumn is returned when an operation requires the values of
+// a row to be sorted by time and they are not.
+var ErrUnsortedTimeColumn = errors.New("row time column is not sorted")
+
+// ErrSeriesMismatch is returned when combining rows from different series.
+var ErrSeriesMismatch = errors.New("rows are not the same series")
+
+// ErrColumnMismatch is returned when rows of the same series have different
+// columns.
+var ErrColumnMismatch = errors.New("rows of the same series have different columns")
+
 // Row represents a single row returned from the execution of a statement.
 type Row struct {
 	Name    string            `json:"name,omitempty"`
@@ -11,6 +45,751 @@ type Row struct {
 	Columns []string          `json:"columns,omitempty"`
 	Values  [][]interface{}   `json:"values,omitempty"`
 	Partial bool              `json:"partial,omitempty"`
+
+	// Meta holds arbitrary annotations for the series, such as the source
+	// shard or timing information. It is not part of the series identity.
+	Meta map[string]interface{} `json:"meta,omitempty"`
+}
+
+// SetMeta sets the metadata value for key, allocating the map if needed.
+func (r *Row) SetMeta(key string, value interface{}) {
+	if r.Meta == nil {
+		r.Meta = make(map[string]interface{})
+	}
+	r.Meta[key] = value
+}
+
+// GetMeta returns the metadata value for key and whether it was set.
+func (r *Row) GetMeta(key string) (interface{}, bool) {
+	v, ok := r.Meta[key]
+	return v, ok
+}
+
+// TimeSpan returns the earliest and latest times in the time column of the
+// row. Times may be stored as time.Time or as int64 nanoseconds since the
+// epoch; values of any other type are ignored. ok is false if the row has no
+// time column or no usable time values.
+func (r *Row) TimeSpan() (start, end time.Time, ok bool) {
+	idx := r.timeIndex()
+	if idx == -1 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	for _, v := range r.Values {
+		if idx >= len(v) {
+			continue
+		}
+		t, valid := valueTime(v[idx])
+		if !valid {
+			continue
+		}
+		if !ok || t.Before(start) {
+			start = t
+		}
+		if !ok || t.After(end) {
+			end = t
+		}
+		ok = true
+	}
+	return start, end, ok
+}
+
+// FilterTimeRange returns a new row containing only the values whose time
+// falls within [start, end). Times may be stored as time.Time or as int64
+// nanoseconds since the epoch; values with any other time type are dropped.
+func (r *Row) FilterTimeRange(start, end time.Time) (*Row, error) {
+	idx := r.timeIndex()
+	if idx == -1 {
+		return nil, ErrNoTimeColumn
+	}
+
+	other := r.emptyCopy()
+	for _, v := range r.Values {
+		if idx >= len(v) {
+			continue
+		}
+		t, ok := valueTime(v[idx])
+		if !ok || t.Before(start) || !t.Before(end) {
+			continue
+		}
+		other.Values = append(other.Values, v)
+	}
+	return other, nil
+}
+
+// FillGaps returns a new row with a value inserted at every missing interval
+// between consecutive values. Inserted values carry the boundary time in the
+// time column and fill in every other column. Values must be sorted by time.
+func (r *Row) FillGaps(interval time.Duration, fill interface{}) (*Row, error) {
+	if interval <= 0 {
+		return nil, errors.New("fill interval must be positive")
+	}
+	idx := r.timeIndex()
+	if idx == -1 {
+		return nil, ErrNoTimeColumn
+	}
+
+	other := r.emptyCopy()
+	var prev time.Time
+	for i, v := range r.Values {
+		if idx >= len(v) {
+			return nil, fmt.Errorf("value %d has no time", i)
+		}
+		t, ok := valueTime(v[idx])
+		if !ok {
+			return nil, fmt.Errorf("invalid time value: %v", v[idx])
+		}
+
+		if i > 0 {
+			if t.Before(prev) {
+				return nil, ErrUnsortedTimeColumn
+			}
+			for ts := prev.Add(interval); ts.Before(t); ts = ts.Add(interval) {
+				values := make([]interface{}, len(r.Columns))
+				for j := range values {
+					values[j] = fill
+				}
+				if _, ok := v[idx].(int64); ok {
+					values[idx] = ts.UnixNano()
+				} else {
+					values[idx] = ts
+				}
+				other.Values = append(other.Values, values)
+			}
+		}
+		other.Values = append(other.Values, v)
+		prev = t
+	}
+	return other, nil
+}
+
+// DeduplicateByTime returns a new row, sorted by time, holding a single value
+// set per time. When several value sets share a time, the first is kept, or
+// the last if keepLast is set; their relative order is that of r.Values. An
+// error is returned if a value has no valid time.
+func (r *Row) DeduplicateByTime(keepLast bool) (*Row, error) {
+	idx := r.timeIndex()
+	if idx == -1 {
+		return nil, ErrNoTimeColumn
+	}
+
+	a := timedValues{values: make([][]interface{}, len(r.Values)), times: make([]time.Time, len(r.Values))}
+	for i, v := range r.Values {
+		if idx >= len(v) {
+			return nil, fmt.Errorf("value %d has no time", i)
+		}
+		t, ok := valueTime(v[idx])
+		if !ok {
+			return nil, fmt.Errorf("invalid time value: %v", v[idx])
+		}
+		a.values[i], a.times[i] = v, t
+	}
+	sort.Stable(a)
+
+	other := r.emptyCopy()
+	for i, v := range a.values {
+		if i > 0 && a.times[i].Equal(a.times[i-1]) {
+			if keepLast {
+				other.Values[len(other.Values)-1] = v
+			}
+			continue
+		}
+		other.Values = append(other.Values, v)
+	}
+	return other, nil
+}
+
+// timedValues sorts value sets by their time.
+type timedValues struct {
+	values [][]interface{}
+	times  []time.Time
+}
+
+// Len implements sort.Interface.
+func (a timedValues) Len() int { return len(a.values) }
+
+// Less implements sort.Interface.
+func (a timedValues) Less(i, j int) bool { return a.times[i].Before(a.times[j]) }
+
+// Swap implements sort.Interface.
+func (a timedValues) Swap(i, j int) {
+	a.values[i], a.values[j] = a.values[j], a.values[i]
+	a.times[i], a.times[j] = a.times[j], a.times[i]
+}
+
+// Union returns a new row containing the values of r followed by the values of
+// o. The columns of the new row are the columns of r followed by any columns
+// only present in o. Cells for columns a row doesn't have are set to nil.
+func (r *Row) Union(o *Row) (*Row, error) {
+	if !r.SameSeries(o) {
+		return nil, ErrSeriesMismatch
+	}
+
+	columns := make([]string, len(r.Columns), len(r.Columns)+len(o.Columns))
+	copy(columns, r.Columns)
+	index := make(map[string]int, cap(columns))
+	for i, c := range columns {
+		index[c] = i
+	}
+	for _, c := range o.Columns {
+		if _, ok := index[c]; !ok {
+			index[c] = len(columns)
+			columns = append(columns, c)
+		}
+	}
+
+	other := r.emptyCopy()
+	other.Columns = columns
+	other.Values = make([][]interface{}, 0, len(r.Values)+len(o.Values))
+	for _, src := range []*Row{r, o} {
+		for _, v := range src.Values {
+			values := make([]interface{}, len(columns))
+			for i, c := range src.Columns {
+				if i < len(v) {
+					values[index[c]] = v[i]
+				}
+			}
+			other.Values = append(other.Values, values)
+		}
+	}
+	return other, nil
+}
+
+// Equal returns true if o has the same name, tags, columns and values as r.
+// Numeric values are compared as floats and are equal if they differ by no
+// more than floatTolerance, so an int64 and a float64 may be equal. Partial
+// and Meta are not compared. A nil row is only equal to another nil row.
+func (r *Row) Equal(o *Row, floatTolerance float64) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	if r.Name != o.Name || len(r.Tags) != len(o.Tags) ||
+		len(r.Columns) != len(o.Columns) || len(r.Values) != len(o.Values) {
+		return false
+	}
+	for k, v := range r.Tags {
+		if ov, ok := o.Tags[k]; !ok || ov != v {
+			return false
+		}
+	}
+	if !stringsEqual(r.Columns, o.Columns) {
+		return false
+	}
+	for i, v := range r.Values {
+		if len(v) != len(o.Values[i]) {
+			return false
+		}
+		for j := range v {
+			if !valuesEqual(v[j], o.Values[i][j], floatTolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// valuesEqual returns true if a and b are equal, comparing numeric values
+// within tolerance.
+func valuesEqual(a, b interface{}, tolerance float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if fa, ok := numericValue(a); ok {
+		fb, ok := numericValue(b)
+		return ok && math.Abs(fa-fb) <= tolerance
+	}
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// WriteLineProtocol writes the values of the row to w as line protocol, one
+// point per value row. The name is used as the measurement, the tags as the
+// tag set and the time column as the timestamp; all other columns are fields.
+// Nil values are omitted and rows without any field values are skipped.
+func (r *Row) WriteLineProtocol(w io.Writer) error {
+	return r.WriteLineProtocolOptions(w, LineProtocolOptions{})
+}
+
+// LineProtocolOptions controls which columns and tags of a row are written
+// by Row.WriteLineProtocolOptions.
+type LineProtocolOptions struct {
+	// Fields lists the columns written as fields. Other columns are ignored.
+	// If nil, every column other than time is a field.
+	Fields []string
+
+	// TagKeys lists the tags written. If nil, every tag is written.
+	TagKeys []string
+}
+
+// WriteLineProtocolOptions is like WriteLineProtocol but writes only the
+// fields and tags selected by opts. An error is returned if a listed field
+// is not a column of the row; listed tags the row lacks are omitted.
+func (r *Row) WriteLineProtocolOptions(w io.Writer, opts LineProtocolOptions) error {
+	idx := r.timeIndex()
+	if idx == -1 {
+		return ErrNoTimeColumn
+	}
+
+	isField := make([]bool, len(r.Columns))
+	if opts.Fields == nil {
+		for i := range r.Columns {
+			isField[i] = i != idx
+		}
+	} else {
+		for _, name := range opts.Fields {
+			i := r.ColumnIndex(name)
+			if i == -1 {
+				return fmt.Errorf("column not found: %s", name)
+			} else if i == idx {
+				return fmt.Errorf("time column can't be a field")
+			}
+			isField[i] = true
+		}
+	}
+
+	m := r.Tags
+	if opts.TagKeys != nil {
+		m = make(map[string]string, len(opts.TagKeys))
+		for _, k := range opts.TagKeys {
+			if v, ok := r.Tags[k]; ok {
+				m[k] = v
+			}
+		}
+	}
+
+	tags := NewTags(m)
+	var buf []byte
+	for _, v := range r.Values {
+		if idx >= len(v) {
+			return fmt.Errorf("missing time value")
+		}
+		t, ok := valueTime(v[idx])
+		if !ok {
+			return fmt.Errorf("invalid time value of type %T", v[idx])
+		}
+
+		fields := make(Fields)
+		for i, c := range r.Columns {
+			if isField[i] && i < len(v) && v[i] != nil {
+				fields[c] = v[i]
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		pt, err := NewPoint(r.Name, tags, fields, t)
+		if err != nil {
+			return err
+		}
+		buf = append(pt.AppendString(buf[:0]), '\n')
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transpose returns the values of the row in column-major order: the i-th
+// slice holds the values of the i-th column, one per row of Values. Rows
+// shorter than the widest row or the list of columns are padded with nil.
+func (r *Row) Transpose() [][]interface{} {
+	n := len(r.Columns)
+	for _, v := range r.Values {
+		if len(v) > n {
+			n = len(v)
+		}
+	}
+
+	columns := make([][]interface{}, n)
+	for i := range columns {
+		columns[i] = make([]interface{}, len(r.Values))
+		for j, v := range r.Values {
+			if i < len(v) {
+				columns[i][j] = v[i]
+			}
+		}
+	}
+	return columns
+}
+
+// AggFunc identifies an aggregation computed by Row.Aggregate.
+type AggFunc int
+
+const (
+	// AggSum is the sum of the values.
+	AggSum AggFunc = iota
+	// AggMean is the arithmetic mean of the values.
+	AggMean
+	// AggMin is the smallest value.
+	AggMin
+	// AggMax is the largest value.
+	AggMax
+	// AggCount is the number of non-nil values.
+	AggCount
+)
+
+// Aggregate computes fn over the values of the named column. Nil values are
+// skipped. An error is returned if the column does not exist or holds a
+// non-numeric value, or if the min, max or mean of a column without values
+// is requested.
+func (r *Row) Aggregate(column string, fn AggFunc) (float64, error) {
+	idx := r.ColumnIndex(column)
+	if idx == -1 {
+		return 0, fmt.Errorf("column not found: %s", column)
+	}
+
+	var sum, min, max float64
+	var n int
+	for _, v := range r.Values {
+		if idx >= len(v) || v[idx] == nil {
+			continue
+		}
+		f, ok := numericValue(v[idx])
+		if !ok {
+			return 0, fmt.Errorf("column %s has non-numeric value of type %T", column, v[idx])
+		}
+		if n == 0 || f < min {
+			min = f
+		}
+		if n == 0 || f > max {
+			max = f
+		}
+		sum += f
+		n++
+	}
+
+	switch fn {
+	case AggSum:
+		return sum, nil
+	case AggCount:
+		return float64(n), nil
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("column %s has no values", column)
+	}
+	switch fn {
+	case AggMean:
+		return sum / float64(n), nil
+	case AggMin:
+		return min, nil
+	case AggMax:
+		return max, nil
+	}
+	return 0, fmt.Errorf("unknown aggregate function: %d", fn)
+}
+
+// numericValue returns v as a float64 if it is a numeric type.
+func numericValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Project returns a new row holding only the named columns, in the order
+// given. An error is returned if a column does not exist.
+func (r *Row) Project(columns ...string) (*Row, error) {
+	idx := make([]int, len(columns))
+	for i, c := range columns {
+		if idx[i] = r.ColumnIndex(c); idx[i] == -1 {
+			return nil, fmt.Errorf("column not found: %s", c)
+		}
+	}
+
+	return r.project(idx), nil
+}
+
+// project returns a new row holding only the columns at the given indexes,
+// in the order given.
+func (r *Row) project(idx []int) *Row {
+	other := r.emptyCopy()
+	other.Columns = make([]string, len(idx))
+	for i, j := range idx {
+		other.Columns[i] = r.Columns[j]
+	}
+	for _, v := range r.Values {
+		values := make([]interface{}, len(idx))
+		for i, j := range idx {
+			if j < len(v) {
+				values[i] = v[j]
+			}
+		}
+		other.Values = append(other.Values, values)
+	}
+	return other
+}
+
+// SplitColumns partitions the columns of the row into rows of at most
+// maxColumns columns each, in order. If the row has a time column, it is
+// the first column of every partition and counts towards maxColumns, so
+// the time of each value is kept in each partition. A maxColumns below 2 is
+// treated as 2 in that case. The name and tags are shared by the partitions.
+// If the row already has at most maxColumns columns, or maxColumns is not
+// positive, the row itself is returned.
+func (r *Row) SplitColumns(maxColumns int) []*Row {
+	if maxColumns <= 0 || len(r.Columns) <= maxColumns {
+		return []*Row{r}
+	}
+
+	ti := r.timeIndex()
+	var fields []int
+	for i := range r.Columns {
+		if i != ti {
+			fields = append(fields, i)
+		}
+	}
+
+	n := maxColumns
+	if ti != -1 {
+		if n < 2 {
+			n = 2
+		}
+		n--
+	}
+
+	var rows []*Row
+	for len(fields) > 0 {
+		m := n
+		if m > len(fields) {
+			m = len(fields)
+		}
+
+		var idx []int
+		if ti != -1 {
+			idx = append(idx, ti)
+		}
+		idx = append(idx, fields[:m]...)
+		rows = append(rows, r.project(idx))
+		fields = fields[m:]
+	}
+	return rows
+}
+
+// CoerceColumnInt converts the float64 values of the named column to int64,
+// restoring integers that were decoded from JSON as floats. Values of other
+// types are left as they are. An error is returned, and the row left
+// unchanged, if any float64 value can't be represented exactly as an int64.
+func (r *Row) CoerceColumnInt(name string) error {
+	idx := r.ColumnIndex(name)
+	if idx == -1 {
+		return fmt.Errorf("column not found: %s", name)
+	}
+
+	for i, v := range r.Values {
+		if idx >= len(v) {
+			continue
+		}
+		if f, ok := v[idx].(float64); ok && !isInt64(f) {
+			return fmt.Errorf("value %d of column %s is not an integer: %v", i, name, f)
+		}
+	}
+
+	for _, v := range r.Values {
+		if idx >= len(v) {
+			continue
+		}
+		if f, ok := v[idx].(float64); ok {
+			v[idx] = int64(f)
+		}
+	}
+	return nil
+}
+
+// DecompressColumn replaces the values of the named column, which hold
+// base64-encoded data compressed with codec, with the decompressed strings.
+// The supported codecs are "gzip" and "snappy". Nil values are left as they
+// are. An error is returned, and the row left unchanged, if any other value
+// is not a string or can't be decoded.
+func (r *Row) DecompressColumn(name string, codec string) error {
+	var decompress func([]byte) ([]byte, error)
+	switch codec {
+	case "gzip":
+		decompress = gunzip
+	case "snappy":
+		decompress = func(b []byte) ([]byte, error) { return snappy.Decode(nil, b) }
+	default:
+		return fmt.Errorf("unknown compression codec: %s", codec)
+	}
+
+	idx := r.ColumnIndex(name)
+	if idx == -1 {
+		return fmt.Errorf("column not found: %s", name)
+	}
+
+	decoded := make([]interface{}, len(r.Values))
+	for i, v := range r.Values {
+		if idx >= len(v) || v[idx] == nil {
+			continue
+		}
+		s, ok := v[idx].(string)
+		if !ok {
+			return fmt.Errorf("value %d of column %s is not a string: %T", i, name, v[idx])
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("value %d of column %s: %s", i, name, err)
+		}
+		if b, err = decompress(b); err != nil {
+			return fmt.Errorf("value %d of column %s: %s", i, name, err)
+		}
+		decoded[i] = string(b)
+	}
+
+	for i, v := range r.Values {
+		if decoded[i] != nil {
+			v[idx] = decoded[i]
+		}
+	}
+	return nil
+}
+
+// gunzip returns the decompressed contents of the gzip data in b.
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TypeConsistency returns the distinct Go types of the values of each column,
+// sorted by name. A column with more than one type has values that a typed
+// sink may reject. Nil values are ignored, and columns holding only nil
+// values are omitted.
+func (r *Row) TypeConsistency() map[string][]string {
+	types := make(map[string][]string)
+	for _, v := range r.Values {
+		for i, c := range r.Columns {
+			if i >= len(v) || v[i] == nil {
+				continue
+			}
+			types[c] = appendType(types[c], fmt.Sprintf("%T", v[i]))
+		}
+	}
+	for _, a := range types {
+		sort.Strings(a)
+	}
+	return types
+}
+
+// appendType appends typ to a if it is not already present.
+func appendType(a []string, typ string) []string {
+	for _, t := range a {
+		if t == typ {
+			return a
+		}
+	}
+	return append(a, typ)
+}
+
+// isInt64 returns true if f has no fractional part and is in the range of an int64.
+func isInt64(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < -math.MinInt64
+}
+
+// timeIndex returns the index of the time column, or -1 if there is none.
+func (r *Row) timeIndex() int {
+	return r.ColumnIndex("time")
+}
+
+// ColumnIndex returns the index of the named column, or -1 if there is none.
+func (r *Row) ColumnIndex(name string) int {
+	for i, c := range r.Columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ColumnIndexFold is like ColumnIndex but matches column names without
+// regard to case. If several columns match, the index of the first is
+// returned.
+func (r *Row) ColumnIndexFold(name string) int {
+	for i, c := range r.Columns {
+		if strings.EqualFold(c, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// emptyCopy returns a copy of the row without any values.
+func (r *Row) emptyCopy() *Row {
+	return &Row{
+		Name:    r.Name,
+		Tags:    r.Tags,
+		Columns: r.Columns,
+		Partial: r.Partial,
+		Meta:    r.Meta,
+	}
+}
+
+// valueTime returns the time represented by a time column value.
+func valueTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case int64:
+		return time.Unix(0, v).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// NormalizeOptions controls how Row.NormalizeTags rewrites tags.
+type NormalizeOptions struct {
+	// TrimSpace removes leading and trailing whitespace from keys and values.
+	TrimSpace bool
+
+	// LowercaseKeys and LowercaseValues convert keys and values to lowercase.
+	LowercaseKeys   bool
+	LowercaseValues bool
+}
+
+// NormalizeTags rewrites the tags of the row according to opts. If several
+// keys are equal after normalization, the value of the key that sorts first
+// before normalization is kept. The tags are replaced rather than modified in
+// place, so maps shared with other rows are left untouched. Normalizing twice
+// with the same options has no further effect.
+func (r *Row) NormalizeTags(opts NormalizeOptions) {
+	if len(r.Tags) == 0 {
+		return
+	}
+
+	tags := make(map[string]string, len(r.Tags))
+	for _, k := range r.tagsKeys() {
+		v := r.Tags[k]
+		if opts.TrimSpace {
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		}
+		if opts.LowercaseKeys {
+			k = strings.ToLower(k)
+		}
+		if opts.LowercaseValues {
+			v = strings.ToLower(v)
+		}
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+	r.Tags = tags
 }
 
 // SameSeries returns true if r contains values for the same series as o.
@@ -18,6 +797,22 @@ func (r *Row) SameSeries(o *Row) bool {
 	return r.tagsHash() == o.tagsHash() && r.Name == o.Name
 }
 
+// SeriesID returns a 64-bit identifier for the series of the row, derived
+// from its name and tag set. Unlike tagsHash, each name, key and value is
+// separated so that rows with different names or differently split tags
+// receive different IDs.
+func (r *Row) SeriesID() uint64 {
+	h := NewInlineFNV64a()
+	h.Write([]byte(r.Name))
+	for _, k := range r.tagsKeys() {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(r.Tags[k]))
+	}
+	return h.Sum64()
+}
+
 // tagsHash returns a hash of tag key/value pairs.
 func (r *Row) tagsHash() uint64 {
 	h := NewInlineFNV64a()
@@ -39,6 +834,262 @@ func (r *Row) tagsKeys() []string {
 	return a
 }
 
+// TagKeys returns the row's tag keys ordered by less, which can be used to
+// present keys in a locale-aware order, e.g. with a collator's comparison.
+// A nil less sorts the keys byte-wise, as the row does internally when
+// hashing tags; that order is unaffected by less.
+func (r *Row) TagKeys(less func(a, b string) bool) []string {
+	a := r.tagsKeys()
+	if less != nil {
+		sort.Stable(stringsBy{a: a, less: less})
+	}
+	return a
+}
+
+// stringsBy sorts strings using a custom comparison.
+type stringsBy struct {
+	a    []string
+	less func(a, b string) bool
+}
+
+// Len implements sort.Interface.
+func (s stringsBy) Len() int { return len(s.a) }
+
+// Less implements sort.Interface.
+func (s stringsBy) Less(i, j int) bool { return s.less(s.a[i], s.a[j]) }
+
+// Swap implements sort.Interface.
+func (s stringsBy) Swap(i, j int) { s.a[i], s.a[j] = s.a[j], s.a[i] }
+
+// Data types of values in the protobuf encoding of a row. They match the
+// influxql data types of the same name. Unsigned, which influxql doesn't
+// have, takes the next free number.
+const (
+	valueTypeNil      = 0
+	valueTypeFloat    = 1
+	valueTypeInteger  = 2
+	valueTypeString   = 3
+	valueTypeBoolean  = 4
+	valueTypeTime     = 5
+	valueTypeDuration = 6
+	valueTypeUnsigned = 9
+)
+
+// ToProto returns the protobuf message for the row. Meta is not included.
+//
+// Signed integers, unsigned integers and floats of every size are widened to
+// int64, uint64 and float64. Strings, booleans, time.Time and time.Duration
+// values keep their type, and values of any other type are encoded as
+// strings formatted with %v.
+func (r *Row) ToProto() *RowPB {
+	pb := &RowPB{
+		Name:    proto.String(r.Name),
+		Columns: r.Columns,
+	}
+	if r.Partial {
+		pb.Partial = proto.Bool(true)
+	}
+	for _, k := range r.tagsKeys() {
+		pb.Tags = append(pb.Tags, &TagPB{Key: proto.String(k), Value: proto.String(r.Tags[k])})
+	}
+
+	pb.Values = make([]*ValuesPB, len(r.Values))
+	for i, values := range r.Values {
+		pb.Values[i] = &ValuesPB{Values: make([]*ValuePB, len(values))}
+		for j, v := range values {
+			pb.Values[i].Values[j] = encodeValue(v)
+		}
+	}
+	return pb
+}
+
+// FromProto sets the row to the one held by a protobuf message. Time values
+// are decoded in UTC.
+func (r *Row) FromProto(pb *RowPB) error {
+	*r = Row{
+		Name:    pb.GetName(),
+		Columns: pb.GetColumns(),
+		Partial: pb.GetPartial(),
+	}
+	if len(pb.GetTags()) > 0 {
+		r.Tags = make(map[string]string, len(pb.Tags))
+		for _, t := range pb.Tags {
+			r.Tags[t.GetKey()] = t.GetValue()
+		}
+	}
+
+	if len(pb.GetValues()) > 0 {
+		r.Values = make([][]interface{}, len(pb.Values))
+		for i, values := range pb.Values {
+			r.Values[i] = make([]interface{}, len(values.GetValues()))
+			for j, v := range values.GetValues() {
+				value, err := decodeValue(v)
+				if err != nil {
+					return fmt.Errorf("value %d of column %d: %s", i, j, err)
+				}
+				r.Values[i][j] = value
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalBinary encodes the row as the protobuf message returned by ToProto.
+func (r *Row) MarshalBinary() ([]byte, error) {
+	return proto.Marshal(r.ToProto())
+}
+
+// UnmarshalBinary decodes a row encoded by MarshalBinary.
+func (r *Row) UnmarshalBinary(buf []byte) error {
+	var pb RowPB
+	if err := proto.Unmarshal(buf, &pb); err != nil {
+		return err
+	}
+	return r.FromProto(&pb)
+}
+
+// encodeValue returns the protobuf encoding of a single value.
+func encodeValue(v interface{}) *ValuePB {
+	switch v := v.(type) {
+	case nil:
+		return &ValuePB{DataType: proto.Int32(valueTypeNil)}
+	case float64:
+		return &ValuePB{DataType: proto.Int32(valueTypeFloat), FloatValue: proto.Float64(v)}
+	case float32:
+		return &ValuePB{DataType: proto.Int32(valueTypeFloat), FloatValue: proto.Float64(float64(v))}
+	case int64:
+		return &ValuePB{DataType: proto.Int32(valueTypeInteger), IntegerValue: proto.Int64(v)}
+	case int:
+		return &ValuePB{DataType: proto.Int32(valueTypeInteger), IntegerValue: proto.Int64(int64(v))}
+	case int32:
+		return &ValuePB{DataType: proto.Int32(valueTypeInteger), IntegerValue: proto.Int64(int64(v))}
+	case int16:
+		return &ValuePB{DataType: proto.Int32(valueTypeInteger), IntegerValue: proto.Int64(int64(v))}
+	case int8:
+		return &ValuePB{DataType: proto.Int32(valueTypeInteger), IntegerValue: proto.Int64(int64(v))}
+	case uint64:
+		return &ValuePB{DataType: proto.Int32(valueTypeUnsigned), UnsignedValue: proto.Uint64(v)}
+	case uint:
+		return &ValuePB{DataType: proto.Int32(valueTypeUnsigned), UnsignedValue: proto.Uint64(uint64(v))}
+	case uint32:
+		return &ValuePB{DataType: proto.Int32(valueTypeUnsigned), UnsignedValue: proto.Uint64(uint64(v))}
+	case uint16:
+		return &ValuePB{DataType: proto.Int32(valueTypeUnsigned), UnsignedValue: proto.Uint64(uint64(v))}
+	case uint8:
+		return &ValuePB{DataType: proto.Int32(valueTypeUnsigned), UnsignedValue: proto.Uint64(uint64(v))}
+	case string:
+		return &ValuePB{DataType: proto.Int32(valueTypeString), StringValue: proto.String(v)}
+	case bool:
+		return &ValuePB{DataType: proto.Int32(valueTypeBoolean), BooleanValue: proto.Bool(v)}
+	case time.Time:
+		return &ValuePB{DataType: proto.Int32(valueTypeTime), IntegerValue: proto.Int64(v.UnixNano())}
+	case time.Duration:
+		return &ValuePB{DataType: proto.Int32(valueTypeDuration), IntegerValue: proto.Int64(int64(v))}
+	default:
+		return &ValuePB{DataType: proto.Int32(valueTypeString), StringValue: proto.String(fmt.Sprintf("%v", v))}
+	}
+}
+
+// decodeValue returns the value held by its protobuf encoding.
+func decodeValue(pb *ValuePB) (interface{}, error) {
+	switch pb.GetDataType() {
+	case valueTypeNil:
+		return nil, nil
+	case valueTypeFloat:
+		return pb.GetFloatValue(), nil
+	case valueTypeInteger:
+		return pb.GetIntegerValue(), nil
+	case valueTypeUnsigned:
+		return pb.GetUnsignedValue(), nil
+	case valueTypeString:
+		return pb.GetStringValue(), nil
+	case valueTypeBoolean:
+		return pb.GetBooleanValue(), nil
+	case valueTypeTime:
+		return time.Unix(0, pb.GetIntegerValue()).UTC(), nil
+	case valueTypeDuration:
+		return time.Duration(pb.GetIntegerValue()), nil
+	default:
+		return nil, fmt.Errorf("unknown data type: %d", pb.GetDataType())
+	}
+}
+
+// RowBuilder constructs a Row, validating its values as they are added.
+// The first error encountered is returned by Build.
+type RowBuilder struct {
+	row Row
+	err error
+}
+
+// NewRowBuilder returns a new RowBuilder for an empty row.
+func NewRowBuilder() *RowBuilder {
+	return &RowBuilder{}
+}
+
+// SetName sets the name of the row.
+func (b *RowBuilder) SetName(name string) *RowBuilder {
+	b.row.Name = name
+	return b
+}
+
+// AddTag sets the tag key to value.
+func (b *RowBuilder) AddTag(key, value string) *RowBuilder {
+	if b.row.Tags == nil {
+		b.row.Tags = make(map[string]string)
+	}
+	b.row.Tags[key] = value
+	return b
+}
+
+// SetColumns sets the columns of the row. It must be called before any
+// values are added.
+func (b *RowBuilder) SetColumns(columns ...string) *RowBuilder {
+	if b.err == nil && len(b.row.Values) > 0 {
+		b.err = errors.New("row builder: columns set after values were added")
+	}
+	b.row.Columns = columns
+	return b
+}
+
+// AddValues appends a set of values, one per column.
+func (b *RowBuilder) AddValues(values ...interface{}) *RowBuilder {
+	if b.err == nil && len(values) != len(b.row.Columns) {
+		b.err = fmt.Errorf("row builder: value set %d has %d values, expected %d",
+			len(b.row.Values), len(values), len(b.row.Columns))
+	}
+	b.row.Values = append(b.row.Values, values)
+	return b
+}
+
+// Build returns the row, or the first error encountered while building it.
+// The row is a copy, so the builder can still be modified and built again
+// without affecting rows it has already returned.
+func (b *RowBuilder) Build() (*Row, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	r := &Row{Name: b.row.Name}
+	if b.row.Tags != nil {
+		r.Tags = make(map[string]string, len(b.row.Tags))
+		for k, v := range b.row.Tags {
+			r.Tags[k] = v
+		}
+	}
+	if b.row.Columns != nil {
+		r.Columns = make([]string, len(b.row.Columns))
+		copy(r.Columns, b.row.Columns)
+	}
+	if b.row.Values != nil {
+		r.Values = make([][]interface{}, len(b.row.Values))
+		for i, values := range b.row.Values {
+			r.Values[i] = make([]interface{}, len(values))
+			copy(r.Values[i], values)
+		}
+	}
+	return r, nil
+}
+
 // Rows represents a collection of rows. Rows implements sort.Interface.
 type Rows []*Row
 
@@ -60,3 +1111,397 @@ func (p Rows) Less(i, j int) bool {
 
 // Swap implements sort.Interface.
 func (p Rows) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// maxTableCellWidth is the number of characters after which values are
+// truncated by WriteTable.
+const maxTableCellWidth = 64
+
+// WriteTable writes the rows to w as aligned text tables, in the same layout
+// as the influx CLI's column format. Each row is preceded by its name and
+// tags. Nil values are written as empty cells and values wider than
+// maxTableCellWidth are truncated.
+func (p Rows) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	for i, r := range p {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		if r.Name != "" {
+			fmt.Fprintf(tw, "name: %s\n", r.Name)
+		}
+		if len(r.Tags) > 0 {
+			tags := make([]string, 0, len(r.Tags))
+			for _, k := range r.tagsKeys() {
+				tags = append(tags, fmt.Sprintf("%s=%s", k, r.Tags[k]))
+			}
+			fmt.Fprintf(tw, "tags: %s\n", strings.Join(tags, ", "))
+		}
+
+		lines := make([]string, len(r.Columns))
+		for j, c := range r.Columns {
+			lines[j] = strings.Repeat("-", len(c))
+		}
+		fmt.Fprintln(tw, strings.Join(r.Columns, "\t"))
+		fmt.Fprintln(tw, strings.Join(lines, "\t"))
+
+		for _, v := range r.Values {
+			cells := make([]string, len(v))
+			for j, vv := range v {
+				cells[j] = tableCell(vv)
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteNDJSON writes every value of every row to w as a JSON object on its
+// own line. Each object holds the tags of the row and the values keyed by
+// their column. A column takes precedence over a tag with the same key. Time
+// column values are written as RFC3339 strings with nanosecond precision.
+func (p Rows) WriteNDJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, r := range p {
+		ti := r.timeIndex()
+		for _, v := range r.Values {
+			obj := make(map[string]interface{}, len(r.Tags)+len(r.Columns))
+			for k, tv := range r.Tags {
+				obj[k] = tv
+			}
+			for i, c := range r.Columns {
+				if i >= len(v) {
+					break
+				}
+				obj[c] = v[i]
+				if i == ti {
+					if t, ok := valueTime(v[i]); ok {
+						obj[c] = t.Format(time.RFC3339Nano)
+					}
+				}
+			}
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tableCell formats a value for WriteTable.
+func tableCell(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	s := strings.NewReplacer("\t", " ", "\n", " ").Replace(fmt.Sprint(v))
+	if r := []rune(s); len(r) > maxTableCellWidth {
+		s = string(r[:maxTableCellWidth-3]) + "..."
+	}
+	return s
+}
+
+// ConcatRows returns the rows of each argument, in order, as a single set.
+// ErrColumnMismatch is returned if two rows of the same series have
+// different columns.
+func ConcatRows(rows ...Rows) (Rows, error) {
+	type seriesKey struct {
+		name string
+		tags uint64
+	}
+
+	var n int
+	for _, a := range rows {
+		n += len(a)
+	}
+
+	other := make(Rows, 0, n)
+	columns := make(map[seriesKey][]string)
+	for _, a := range rows {
+		for _, r := range a {
+			key := seriesKey{name: r.Name, tags: r.tagsHash()}
+			if c, ok := columns[key]; !ok {
+				columns[key] = r.Columns
+			} else if !stringsEqual(c, r.Columns) {
+				return nil, ErrColumnMismatch
+			}
+			other = append(other, r)
+		}
+	}
+	return other, nil
+}
+
+// StitchPartials reads rows from in and joins the partial rows of each series
+// into a single row. Values are appended in the order the rows arrive and the
+// joined row is sent once a non-partial row for the series is read. Rows of
+// different series may be interleaved. If in is closed while rows are still
+// pending, they are sent in the order their series first appeared, still
+// marked as partial. The returned channel is closed after in is.
+func StitchPartials(in <-chan *Row) <-chan *Row {
+	out := make(chan *Row)
+	go func() {
+		defer close(out)
+
+		pending := make(map[uint64]*Row)
+		var order []uint64
+		for r := range in {
+			if r == nil {
+				continue
+			}
+
+			id := r.SeriesID()
+			prev, ok := pending[id]
+			if !ok {
+				prev = r.emptyCopy()
+				prev.Values = make([][]interface{}, 0, len(r.Values))
+				pending[id] = prev
+				order = append(order, id)
+			}
+			if stringsEqual(prev.Columns, r.Columns) {
+				prev.Values = append(prev.Values, r.Values...)
+			} else {
+				// Union can't fail, both rows belong to the same series.
+				prev, _ = prev.Union(r)
+				pending[id] = prev
+			}
+
+			if r.Partial {
+				continue
+			}
+			prev.Partial = false
+			delete(pending, id)
+			for i := range order {
+				if order[i] == id {
+					order = append(order[:i], order[i+1:]...)
+					break
+				}
+			}
+			out <- prev
+		}
+
+		for _, id := range order {
+			out <- pending[id]
+		}
+	}()
+	return out
+}
+
+// CheckConsistency returns every problem found in the rows: rows without a
+// name, value sets whose length differs from the number of columns, series
+// that appear in more than one row, and rows of the same series with a
+// different number of columns. It returns nil if no problems are found.
+func (p Rows) CheckConsistency() []error {
+	var errs []error
+	seen := make(map[uint64]int)
+	for i, r := range p {
+		if r.Name == "" {
+			errs = append(errs, fmt.Errorf("row %d: empty name", i))
+		}
+		for j, v := range r.Values {
+			if len(v) != len(r.Columns) {
+				errs = append(errs, fmt.Errorf("row %d: value set %d has %d values, expected %d",
+					i, j, len(v), len(r.Columns)))
+			}
+		}
+
+		key := r.SeriesID()
+		if first, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("row %d: duplicate of series in row %d", i, first))
+			if n := len(p[first].Columns); n != len(r.Columns) {
+				errs = append(errs, fmt.Errorf("row %d: has %d columns, row %d of the same series has %d",
+					i, len(r.Columns), first, n))
+			}
+			continue
+		}
+		seen[key] = i
+	}
+	return errs
+}
+
+// stringsEqual returns true if a and b hold the same strings in the same order.
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterByTagPattern returns the rows whose value for the tag key matches
+// pattern. Patterns are globs, where "*" matches any sequence of characters
+// and "?" matches a single character, unless enclosed in slashes, in which
+// case they are regular expressions, e.g. "/^web-[0-9]+$/". Rows without
+// the tag never match.
+func (p Rows) FilterByTagPattern(key, pattern string) (Rows, error) {
+	re, err := compileTagPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var other Rows
+	for _, r := range p {
+		if v, ok := r.Tags[key]; ok && re.MatchString(v) {
+			other = append(other, r)
+		}
+	}
+	return other, nil
+}
+
+// ReplaceTagValues rewrites the value of the tag key of every row according
+// to mapping, e.g. to anonymize results before sharing them. Values missing
+// from mapping, and rows without the tag, are left untouched. As with
+// NormalizeTags, the tags of a changed row are replaced rather than modified
+// in place, so maps shared with other rows are left untouched.
+func (p Rows) ReplaceTagValues(key string, mapping map[string]string) {
+	for _, r := range p {
+		v, ok := r.Tags[key]
+		if !ok {
+			continue
+		}
+		nv, ok := mapping[v]
+		if !ok || nv == v {
+			continue
+		}
+
+		tags := make(map[string]string, len(r.Tags))
+		for k, v := range r.Tags {
+			tags[k] = v
+		}
+		tags[key] = nv
+		r.Tags = tags
+	}
+}
+
+// compileTagPattern compiles a glob or slash-delimited regular expression.
+func compileTagPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.Compile("^" + expr + "$")
+}
+
+// AnyPartial returns true if any row in the collection is partial.
+func (p Rows) AnyPartial() bool {
+	for _, r := range p {
+		if r.Partial {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksum returns a hash of the series, columns and values of the rows.
+// Rows are hashed independently and combined in sorted order, so the
+// checksum doesn't depend on the order of the rows. The order of the values
+// within a row does matter.
+func (p Rows) Checksum() uint64 {
+	sums := make(uint64s, 0, len(p))
+	for _, r := range p {
+		if r != nil {
+			sums = append(sums, r.checksum())
+		}
+	}
+	sort.Sort(sums)
+
+	h := NewInlineFNV64a()
+	var buf [8]byte
+	for _, sum := range sums {
+		binary.BigEndian.PutUint64(buf[:], sum)
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// checksum returns a hash of the series, columns and values of the row.
+func (r *Row) checksum() uint64 {
+	h := NewInlineFNV64a()
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:], r.SeriesID())
+	h.Write(buf[:8])
+
+	for _, c := range r.Columns {
+		h.Write([]byte(c))
+		h.Write([]byte{0})
+	}
+	for _, values := range r.Values {
+		// Separate the value rows so values can't shift between them.
+		h.Write([]byte{0xff})
+		for _, v := range values {
+			switch v := v.(type) {
+			case nil:
+				h.Write([]byte{valueTypeNil})
+			case float64:
+				buf[0] = valueTypeFloat
+				binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+				h.Write(buf[:])
+			case int64:
+				buf[0] = valueTypeInteger
+				binary.BigEndian.PutUint64(buf[1:], uint64(v))
+				h.Write(buf[:])
+			case bool:
+				buf[0], buf[1] = valueTypeBoolean, 0
+				if v {
+					buf[1] = 1
+				}
+				h.Write(buf[:2])
+			case time.Time:
+				buf[0] = valueTypeTime
+				binary.BigEndian.PutUint64(buf[1:], uint64(v.UnixNano()))
+				h.Write(buf[:])
+			case string:
+				h.Write([]byte{valueTypeString})
+				h.Write([]byte(v))
+				h.Write([]byte{0})
+			default:
+				h.Write([]byte(fmt.Sprintf("%T:%v", v, v)))
+				h.Write([]byte{0})
+			}
+		}
+	}
+	return h.Sum64()
+}
+
+// uint64s sorts a slice of uint64s in increasing order.
+type uint64s []uint64
+
+func (a uint64s) Len() int           { return len(a) }
+func (a uint64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// RowValueIterator walks the values of a collection of rows.
+type RowValueIterator interface {
+	// Next returns the index of the row the next values belong to, along
+	// with the values. ok is false once all values have been returned.
+	Next() (seriesIdx int, values []interface{}, ok bool)
+}
+
+// Iterator returns an iterator over the values of every row, in order, that
+// doesn't copy them. Modifying the rows while iterating is not supported.
+func (p Rows) Iterator() RowValueIterator {
+	return &rowValueIterator{rows: p}
+}
+
+// rowValueIterator implements RowValueIterator.
+type rowValueIterator struct {
+	rows Rows
+	i, j int
+}
+
+// Next implements RowValueIterator.
+func (itr *rowValueIterator) Next() (int, []interface{}, bool) {
+	for ; itr.i < len(itr.rows); itr.i, itr.j = itr.i+1, 0 {
+		if r := itr.rows[itr.i]; r != nil && itr.j < len(r.Values) {
+			itr.j++
+			return itr.i, r.Values[itr.j-1], true
+		}
+	}
+	return 0, nil, false
+}
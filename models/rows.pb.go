@@ -0,0 +1,212 @@
+// Code generated by protoc-gen-gogo.
+// source: rows.proto
+// DO NOT EDIT!
+
+/*
+Package models is a generated protocol buffer package.
+
+It is generated from these files:
+	rows.proto
+
+It has these top-level messages:
+	RowPB
+	TagPB
+	ValuesPB
+	ValuePB
+*/
+package models
+
+import proto "github.com/gogo/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
+
+type RowPB struct {
+	Name             *string     `protobuf:"bytes,1,req,name=Name" json:"Name,omitempty"`
+	Tags             []*TagPB    `protobuf:"bytes,2,rep,name=Tags" json:"Tags,omitempty"`
+	Columns          []string    `protobuf:"bytes,3,rep,name=Columns" json:"Columns,omitempty"`
+	Values           []*ValuesPB `protobuf:"bytes,4,rep,name=Values" json:"Values,omitempty"`
+	Partial          *bool       `protobuf:"varint,5,opt,name=Partial" json:"Partial,omitempty"`
+	XXX_unrecognized []byte      `json:"-"`
+}
+
+func (m *RowPB) Reset()                    { *m = RowPB{} }
+func (m *RowPB) String() string            { return proto.CompactTextString(m) }
+func (*RowPB) ProtoMessage()               {}
+func (*RowPB) Descriptor() ([]byte, []int) { return fileDescriptorRows, []int{0} }
+
+func (m *RowPB) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *RowPB) GetTags() []*TagPB {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *RowPB) GetColumns() []string {
+	if m != nil {
+		return m.Columns
+	}
+	return nil
+}
+
+func (m *RowPB) GetValues() []*ValuesPB {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+func (m *RowPB) GetPartial() bool {
+	if m != nil && m.Partial != nil {
+		return *m.Partial
+	}
+	return false
+}
+
+type TagPB struct {
+	Key              *string `protobuf:"bytes,1,req,name=Key" json:"Key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=Value" json:"Value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TagPB) Reset()                    { *m = TagPB{} }
+func (m *TagPB) String() string            { return proto.CompactTextString(m) }
+func (*TagPB) ProtoMessage()               {}
+func (*TagPB) Descriptor() ([]byte, []int) { return fileDescriptorRows, []int{1} }
+
+func (m *TagPB) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *TagPB) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+type ValuesPB struct {
+	Values           []*ValuePB `protobuf:"bytes,1,rep,name=Values" json:"Values,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *ValuesPB) Reset()                    { *m = ValuesPB{} }
+func (m *ValuesPB) String() string            { return proto.CompactTextString(m) }
+func (*ValuesPB) ProtoMessage()               {}
+func (*ValuesPB) Descriptor() ([]byte, []int) { return fileDescriptorRows, []int{2} }
+
+func (m *ValuesPB) GetValues() []*ValuePB {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+type ValuePB struct {
+	DataType         *int32   `protobuf:"varint,1,req,name=DataType" json:"DataType,omitempty"`
+	FloatValue       *float64 `protobuf:"fixed64,2,opt,name=FloatValue" json:"FloatValue,omitempty"`
+	IntegerValue     *int64   `protobuf:"varint,3,opt,name=IntegerValue" json:"IntegerValue,omitempty"`
+	StringValue      *string  `protobuf:"bytes,4,opt,name=StringValue" json:"StringValue,omitempty"`
+	BooleanValue     *bool    `protobuf:"varint,5,opt,name=BooleanValue" json:"BooleanValue,omitempty"`
+	UnsignedValue    *uint64  `protobuf:"varint,6,opt,name=UnsignedValue" json:"UnsignedValue,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *ValuePB) Reset()                    { *m = ValuePB{} }
+func (m *ValuePB) String() string            { return proto.CompactTextString(m) }
+func (*ValuePB) ProtoMessage()               {}
+func (*ValuePB) Descriptor() ([]byte, []int) { return fileDescriptorRows, []int{3} }
+
+func (m *ValuePB) GetDataType() int32 {
+	if m != nil && m.DataType != nil {
+		return *m.DataType
+	}
+	return 0
+}
+
+func (m *ValuePB) GetFloatValue() float64 {
+	if m != nil && m.FloatValue != nil {
+		return *m.FloatValue
+	}
+	return 0
+}
+
+func (m *ValuePB) GetIntegerValue() int64 {
+	if m != nil && m.IntegerValue != nil {
+		return *m.IntegerValue
+	}
+	return 0
+}
+
+func (m *ValuePB) GetStringValue() string {
+	if m != nil && m.StringValue != nil {
+		return *m.StringValue
+	}
+	return ""
+}
+
+func (m *ValuePB) GetBooleanValue() bool {
+	if m != nil && m.BooleanValue != nil {
+		return *m.BooleanValue
+	}
+	return false
+}
+
+func (m *ValuePB) GetUnsignedValue() uint64 {
+	if m != nil && m.UnsignedValue != nil {
+		return *m.UnsignedValue
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*RowPB)(nil), "models.RowPB")
+	proto.RegisterType((*TagPB)(nil), "models.TagPB")
+	proto.RegisterType((*ValuesPB)(nil), "models.ValuesPB")
+	proto.RegisterType((*ValuePB)(nil), "models.ValuePB")
+}
+
+func init() { proto.RegisterFile("rows.proto", fileDescriptorRows) }
+
+var fileDescriptorRows = []byte{
+	// 300 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x54, 0x90, 0xcd, 0x4a, 0x03, 0x31,
+	0x14, 0x85, 0x49, 0x33, 0xd3, 0x9f, 0x5b, 0x8b, 0xe5, 0xe2, 0x22, 0xb8, 0x90, 0x38, 0x08, 0x66,
+	0x55, 0x41, 0xdf, 0x60, 0x14, 0x41, 0x04, 0x19, 0x62, 0x75, 0x1f, 0x68, 0x18, 0x0a, 0x69, 0x52,
+	0x26, 0x29, 0xa5, 0xef, 0xe2, 0x6b, 0xf9, 0x3e, 0xd2, 0x64, 0xa6, 0x76, 0x76, 0x39, 0x5f, 0xce,
+	0xb9, 0xf7, 0x70, 0x01, 0x1a, 0xb7, 0xf7, 0x8b, 0x6d, 0xe3, 0x82, 0xc3, 0xe1, 0xc6, 0xad, 0xb4,
+	0xf1, 0xc5, 0x0f, 0x81, 0x5c, 0xba, 0x7d, 0x55, 0x22, 0x42, 0xf6, 0xa1, 0x36, 0x9a, 0x11, 0x3e,
+	0x10, 0x13, 0x19, 0xdf, 0x78, 0x0b, 0xd9, 0x52, 0xd5, 0x9e, 0x0d, 0x38, 0x15, 0xd3, 0xc7, 0xd9,
+	0x22, 0x85, 0x16, 0x4b, 0x55, 0x57, 0xa5, 0x8c, 0x5f, 0xc8, 0x60, 0xf4, 0xec, 0xcc, 0x6e, 0x63,
+	0x3d, 0xa3, 0x9c, 0x8a, 0x89, 0xec, 0x24, 0x0a, 0x18, 0x7e, 0x2b, 0xb3, 0xd3, 0x9e, 0x65, 0x31,
+	0x3e, 0xef, 0xe2, 0x89, 0x56, 0xa5, 0x6c, 0xff, 0x8f, 0x33, 0x2a, 0xd5, 0x84, 0xb5, 0x32, 0x2c,
+	0xe7, 0x44, 0x8c, 0x65, 0x27, 0x8b, 0x07, 0xc8, 0xe3, 0x32, 0x9c, 0x03, 0x7d, 0xd7, 0x87, 0xb6,
+	0xdc, 0xf1, 0x89, 0x57, 0x90, 0xc7, 0x38, 0x1b, 0x44, 0x96, 0x44, 0xf1, 0x04, 0xe3, 0x6e, 0x3c,
+	0xde, 0x9f, 0x0a, 0x90, 0x58, 0xe0, 0xb2, 0x57, 0xe0, 0x7f, 0x7f, 0xf1, 0x4b, 0x60, 0xd4, 0x32,
+	0xbc, 0x86, 0xf1, 0x8b, 0x0a, 0x6a, 0x79, 0xd8, 0xa6, 0x53, 0xe4, 0xf2, 0xa4, 0xf1, 0x06, 0xe0,
+	0xd5, 0x38, 0x15, 0xba, 0xbd, 0x44, 0x10, 0x79, 0x46, 0xb0, 0x80, 0x8b, 0x37, 0x1b, 0x74, 0xad,
+	0x9b, 0xe4, 0xa0, 0x9c, 0x08, 0x2a, 0x7b, 0x0c, 0x39, 0x4c, 0x3f, 0x43, 0xb3, 0xb6, 0x75, 0xb2,
+	0x64, 0x9c, 0x88, 0x89, 0x3c, 0x47, 0xc7, 0x29, 0xa5, 0x73, 0x46, 0x2b, 0x9b, 0x2c, 0xe9, 0x24,
+	0x3d, 0x86, 0x77, 0x30, 0xfb, 0xb2, 0x7e, 0x5d, 0x5b, 0xbd, 0x4a, 0xa6, 0x21, 0x27, 0x22, 0x93,
+	0x7d, 0xf8, 0x37, 0x00, 0x8f, 0x44, 0x86, 0x40, 0xf1, 0x01, 0x00, 0x00,
+}
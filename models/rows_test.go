@@ -0,0 +1,994 @@
+package models_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Ensure metadata does not affect series identity.
+func TestRow_Meta(t *testing.T) {
+	a := &models.Row{Name: "cpu", Tags: map[string]string{"host": "serverA"}}
+	b := &models.Row{Name: "cpu", Tags: map[string]string{"host": "serverA"}}
+	a.SetMeta("shard", uint64(1))
+
+	if v, ok := a.GetMeta("shard"); !ok || v != uint64(1) {
+		t.Fatalf("unexpected meta: %v (%v)", v, ok)
+	} else if _, ok := b.GetMeta("shard"); ok {
+		t.Fatal("expected no meta")
+	} else if !a.SameSeries(b) {
+		t.Fatal("expected rows to be the same series")
+	}
+}
+
+// Ensure the earliest and latest times of a row are reported.
+func TestRow_TimeSpan(t *testing.T) {
+	r := &models.Row{
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{int64(20), 1.0},
+			{time.Unix(0, 5).UTC(), 2.0},
+			{"bad", 3.0},
+			{int64(30), 4.0},
+			{nil, 5.0},
+		},
+	}
+	start, end, ok := r.TimeSpan()
+	if !ok {
+		t.Fatal("expected a time span")
+	} else if !start.Equal(time.Unix(0, 5)) || !end.Equal(time.Unix(0, 30)) {
+		t.Fatalf("unexpected time span: %s - %s", start, end)
+	}
+
+	for _, r := range []*models.Row{
+		{Columns: []string{"value"}, Values: [][]interface{}{{1.0}}},
+		{Columns: []string{"time", "value"}},
+		{Columns: []string{"time", "value"}, Values: [][]interface{}{{nil, 1.0}}},
+	} {
+		if _, _, ok := r.TimeSpan(); ok {
+			t.Fatalf("unexpected time span for %v", r)
+		}
+	}
+}
+
+// Ensure values can be filtered by time range.
+func TestRow_FilterTimeRange(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{time.Unix(0, 0), 1.0},
+			{int64(10), 2.0},
+			{time.Unix(0, 20), 3.0},
+		},
+	}
+
+	other, err := r.FilterTimeRange(time.Unix(0, 10), time.Unix(0, 20))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Values, [][]interface{}{{int64(10), 2.0}}) {
+		t.Fatalf("unexpected values: %v", other.Values)
+	}
+
+	r.Columns = []string{"value"}
+	if _, err := r.FilterTimeRange(time.Unix(0, 0), time.Unix(0, 20)); err != models.ErrNoTimeColumn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure missing intervals are filled.
+func TestRow_FillGaps(t *testing.T) {
+	r := &models.Row{
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{int64(0), 1.0},
+			{int64(30), 2.0},
+			{int64(40), 3.0},
+		},
+	}
+
+	other, err := r.FillGaps(10, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Values, [][]interface{}{
+		{int64(0), 1.0},
+		{int64(10), nil},
+		{int64(20), nil},
+		{int64(30), 2.0},
+		{int64(40), 3.0},
+	}) {
+		t.Fatalf("unexpected values: %v", other.Values)
+	}
+
+	r.Values[0], r.Values[1] = r.Values[1], r.Values[0]
+	if _, err := r.FillGaps(10, nil); err != models.ErrUnsortedTimeColumn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a row survives a round trip through its protobuf message.
+func TestRow_ToProto(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "server01", "region": "us-west"},
+		Columns: []string{"time", "float", "integer", "unsigned", "string", "boolean", "duration", "empty"},
+		Values: [][]interface{}{
+			{time.Unix(0, 10).UTC(), 1.5, int64(-2), uint64(3), "a", true, time.Second, nil},
+			{time.Unix(20, 0).UTC(), math.Inf(-1), int64(math.MaxInt64), uint64(math.MaxUint64), "", false, time.Duration(-1), nil},
+		},
+		Partial: true,
+	}
+
+	var other models.Row
+	if err := other.FromProto(r.ToProto()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(&other, r) {
+		t.Fatalf("unexpected row:\n\ngot=%#v\n\nexp=%#v", other, r)
+	}
+
+	// A row without tags or values decodes with nil maps and slices.
+	if err := other.FromProto((&models.Row{Name: "mem"}).ToProto()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other, models.Row{Name: "mem"}) {
+		t.Fatalf("unexpected row: %#v", other)
+	}
+}
+
+// Ensure values of every scalar type are encoded, widening sized numbers.
+func TestRow_ToProto_Values(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		exp   interface{}
+	}{
+		{value: nil, exp: nil},
+		{value: float64(1.5), exp: float64(1.5)},
+		{value: float32(1.5), exp: float64(1.5)},
+		{value: int64(-1), exp: int64(-1)},
+		{value: int(-1), exp: int64(-1)},
+		{value: int32(math.MinInt32), exp: int64(math.MinInt32)},
+		{value: int16(-1), exp: int64(-1)},
+		{value: int8(-1), exp: int64(-1)},
+		{value: uint64(math.MaxUint64), exp: uint64(math.MaxUint64)},
+		{value: uint(1), exp: uint64(1)},
+		{value: uint32(math.MaxUint32), exp: uint64(math.MaxUint32)},
+		{value: uint16(1), exp: uint64(1)},
+		{value: uint8(1), exp: uint64(1)},
+		{value: "a", exp: "a"},
+		{value: true, exp: true},
+		{value: time.Unix(1, 2).UTC(), exp: time.Unix(1, 2).UTC()},
+		{value: time.Minute, exp: time.Minute},
+		{value: []int{1, 2}, exp: "[1 2]"},
+	} {
+		r := &models.Row{Name: "cpu", Columns: []string{"value"}, Values: [][]interface{}{{tt.value}}}
+
+		// Go through the binary encoding to check the message marshals.
+		buf, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T: %s", tt.value, err)
+		}
+		var other models.Row
+		if err := other.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("%T: %s", tt.value, err)
+		} else if v := other.Values[0][0]; !reflect.DeepEqual(v, tt.exp) {
+			t.Fatalf("%T: unexpected value: %#v", tt.value, v)
+		}
+	}
+}
+
+// Ensure an unknown value data type is rejected.
+func TestRow_FromProto_UnknownType(t *testing.T) {
+	pb := (&models.Row{Name: "cpu", Columns: []string{"value"}, Values: [][]interface{}{{int64(1)}}}).ToProto()
+	pb.Values[0].Values[0].DataType = proto.Int32(100)
+
+	var r models.Row
+	if err := r.FromProto(pb); err == nil {
+		t.Fatal("expected error for unknown data type")
+	}
+}
+
+// Ensure float values of a column are converted to integers without loss.
+func TestRow_CoerceColumnInt(t *testing.T) {
+	r := &models.Row{
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{int64(1), float64(10)},
+			{int64(2), int64(20)},
+			{int64(3), nil},
+			{int64(4), float64(-1 << 53)},
+		},
+	}
+	if err := r.CoerceColumnInt("value"); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]interface{}{
+		{int64(1), int64(10)},
+		{int64(2), int64(20)},
+		{int64(3), nil},
+		{int64(4), int64(-1 << 53)},
+	}
+	if !reflect.DeepEqual(r.Values, exp) {
+		t.Fatalf("unexpected values: %v", r.Values)
+	}
+
+	for _, f := range []float64{1.5, math.NaN(), math.Inf(1), 1e19} {
+		r := &models.Row{
+			Columns: []string{"value"},
+			Values:  [][]interface{}{{float64(1)}, {f}},
+		}
+		if err := r.CoerceColumnInt("value"); err == nil {
+			t.Fatalf("expected error for %v", f)
+		} else if r.Values[0][0] != float64(1) {
+			t.Fatalf("row modified on error: %v", r.Values)
+		}
+	}
+
+	if err := r.CoerceColumnInt("missing"); err == nil {
+		t.Fatal("expected error for missing column")
+	}
+}
+
+// Ensure compressed string columns are decompressed in place.
+func TestRow_DecompressColumn(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello gzip"))
+	zw.Close()
+	gz := base64.StdEncoding.EncodeToString(buf.Bytes())
+	sz := base64.StdEncoding.EncodeToString(snappy.Encode(nil, []byte("hello snappy")))
+
+	for _, tt := range []struct {
+		codec string
+		value string
+		exp   string
+	}{
+		{codec: "gzip", value: gz, exp: "hello gzip"},
+		{codec: "snappy", value: sz, exp: "hello snappy"},
+	} {
+		r := &models.Row{
+			Columns: []string{"time", "payload"},
+			Values: [][]interface{}{
+				{int64(1), tt.value},
+				{int64(2), nil},
+			},
+		}
+		if err := r.DecompressColumn("payload", tt.codec); err != nil {
+			t.Fatalf("%s: %s", tt.codec, err)
+		}
+		exp := [][]interface{}{{int64(1), tt.exp}, {int64(2), nil}}
+		if !reflect.DeepEqual(r.Values, exp) {
+			t.Fatalf("%s: unexpected values: %v", tt.codec, r.Values)
+		}
+	}
+
+	for _, v := range []interface{}{int64(1), "not base64!", base64.StdEncoding.EncodeToString([]byte("not gzip"))} {
+		r := &models.Row{
+			Columns: []string{"payload"},
+			Values:  [][]interface{}{{gz}, {v}},
+		}
+		if err := r.DecompressColumn("payload", "gzip"); err == nil {
+			t.Fatalf("expected error for %v", v)
+		} else if r.Values[0][0] != gz {
+			t.Fatalf("row modified on error: %v", r.Values)
+		}
+	}
+
+	r := &models.Row{Columns: []string{"payload"}}
+	if err := r.DecompressColumn("payload", "lz4"); err == nil {
+		t.Fatal("expected error for unknown codec")
+	} else if err := r.DecompressColumn("missing", "gzip"); err == nil {
+		t.Fatal("expected error for missing column")
+	}
+}
+
+// Ensure the distinct value types of each column are reported.
+func TestRow_TypeConsistency(t *testing.T) {
+	r := &models.Row{
+		Columns: []string{"time", "value", "host", "empty"},
+		Values: [][]interface{}{
+			{int64(0), 1.5, "a", nil},
+			{int64(10), int64(2), nil, nil},
+			{int64(20), 3.5, "b"},
+		},
+	}
+
+	exp := map[string][]string{
+		"time":  {"int64"},
+		"value": {"float64", "int64"},
+		"host":  {"string"},
+	}
+	if got := r.TypeConsistency(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected types: %v", got)
+	}
+}
+
+// Ensure tag keys are sorted byte-wise by default or with a custom order.
+func TestRow_TagKeys(t *testing.T) {
+	r := &models.Row{Tags: map[string]string{"zone": "a", "Host": "b", "éclair": "c"}}
+
+	if keys := r.TagKeys(nil); !reflect.DeepEqual(keys, []string{"Host", "zone", "éclair"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	fold := func(a, b string) bool {
+		return strings.ToLower(strings.Replace(a, "é", "e", -1)) < strings.ToLower(strings.Replace(b, "é", "e", -1))
+	}
+	if keys := r.TagKeys(fold); !reflect.DeepEqual(keys, []string{"éclair", "Host", "zone"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// Ensure duplicate times are resolved by keeping the first or last value.
+func TestRow_DeduplicateByTime(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{int64(20), 3.0},
+			{int64(10), 1.0},
+			{int64(20), 4.0},
+			{int64(10), 2.0},
+		},
+	}
+
+	if other, err := r.DeduplicateByTime(false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Values, [][]interface{}{{int64(10), 1.0}, {int64(20), 3.0}}) {
+		t.Fatalf("unexpected values: %v", other.Values)
+	}
+
+	if other, err := r.DeduplicateByTime(true); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Values, [][]interface{}{{int64(10), 2.0}, {int64(20), 4.0}}) {
+		t.Fatalf("unexpected values: %v", other.Values)
+	}
+
+	r.Values = append(r.Values, []interface{}{"bad", 5.0})
+	if _, err := r.DeduplicateByTime(true); err == nil {
+		t.Fatal("expected error for invalid time")
+	}
+}
+
+// Ensure rows with different columns can be combined.
+func TestRow_Union(t *testing.T) {
+	a := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "value"},
+		Values:  [][]interface{}{{int64(0), 1.0}},
+	}
+	b := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "idle", "value"},
+		Values:  [][]interface{}{{int64(10), 5.0, 2.0}},
+	}
+
+	other, err := a.Union(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Columns, []string{"time", "value", "idle"}) {
+		t.Fatalf("unexpected columns: %v", other.Columns)
+	} else if !reflect.DeepEqual(other.Values, [][]interface{}{
+		{int64(0), 1.0, nil},
+		{int64(10), 2.0, 5.0},
+	}) {
+		t.Fatalf("unexpected values: %v", other.Values)
+	}
+
+	b.Name = "mem"
+	if _, err := a.Union(b); err != models.ErrSeriesMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure rows are compared with a tolerance for float values.
+func TestRow_Equal(t *testing.T) {
+	x := 0.1
+	a := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "value", "region"},
+		Values:  [][]interface{}{{int64(0), x + 0.2, "west"}, {int64(10), nil, nil}},
+	}
+	b := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "value", "region"},
+		Values:  [][]interface{}{{0.0, 0.3, "west"}, {int64(10), nil, nil}},
+	}
+
+	if !a.Equal(b, 1e-9) {
+		t.Fatal("expected rows to be equal")
+	} else if a.Equal(b, 0) {
+		t.Fatal("expected rows to differ without tolerance")
+	}
+
+	b.Values[1][1] = 1.0
+	if a.Equal(b, 1e-9) {
+		t.Fatal("expected nil and non-nil values to differ")
+	}
+
+	b.Values[1][1] = nil
+	b.Tags = map[string]string{"host": "b"}
+	if a.Equal(b, 1e-9) {
+		t.Fatal("expected rows with different tags to differ")
+	}
+
+	var n *models.Row
+	if a.Equal(nil, 0) {
+		t.Fatal("expected row to differ from nil")
+	} else if n.Equal(a, 0) {
+		t.Fatal("expected nil to differ from row")
+	} else if !n.Equal(nil, 0) {
+		t.Fatal("expected nil rows to be equal")
+	}
+}
+
+// Ensure a row is serialized to line protocol.
+func TestRow_WriteLineProtocol(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "server 01"},
+		Columns: []string{"time", "value", "count", "status", "ok"},
+		Values: [][]interface{}{
+			{int64(10), 1.5, int64(2), "up", true},
+			{time.Unix(0, 20), nil, int64(3), nil, nil},
+			{int64(30), nil, nil, nil, nil},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteLineProtocol(&buf); err != nil {
+		t.Fatal(err)
+	} else if got, exp := buf.String(), "cpu,host=server\\ 01 count=2i,ok=true,status=\"up\",value=1.5 10\ncpu,host=server\\ 01 count=3i 20\n"; got != exp {
+		t.Fatalf("unexpected line protocol:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+
+	r.Columns = []string{"value"}
+	if err := r.WriteLineProtocol(&buf); err != models.ErrNoTimeColumn {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure line protocol is restricted to the selected fields and tags.
+func TestRow_WriteLineProtocolOptions(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a", "region": "west", "secret": "x"},
+		Columns: []string{"time", "value", "derived", "count"},
+		Values: [][]interface{}{
+			{int64(10), 1.5, 3.0, int64(2)},
+			{int64(20), nil, 4.0, nil},
+		},
+	}
+
+	var buf bytes.Buffer
+	opts := models.LineProtocolOptions{
+		Fields:  []string{"value", "count"},
+		TagKeys: []string{"host", "region", "missing"},
+	}
+	if err := r.WriteLineProtocolOptions(&buf, opts); err != nil {
+		t.Fatal(err)
+	} else if got, exp := buf.String(), "cpu,host=a,region=west count=2i,value=1.5 10\n"; got != exp {
+		t.Fatalf("unexpected line protocol:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+
+	buf.Reset()
+	if err := r.WriteLineProtocolOptions(&buf, models.LineProtocolOptions{TagKeys: []string{}}); err != nil {
+		t.Fatal(err)
+	} else if got, exp := buf.String(), "cpu count=2i,derived=3,value=1.5 10\ncpu derived=4 20\n"; got != exp {
+		t.Fatalf("unexpected line protocol:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+
+	for _, fields := range [][]string{{"missing"}, {"time"}} {
+		if err := r.WriteLineProtocolOptions(&buf, models.LineProtocolOptions{Fields: fields}); err == nil {
+			t.Fatalf("expected error for fields %v", fields)
+		}
+	}
+}
+
+// Ensure a row can be transposed into columns, padding ragged values.
+func TestRow_Transpose(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{int64(0), 1.0},
+			{int64(10)},
+		},
+	}
+
+	if got, exp := r.Transpose(), [][]interface{}{
+		{int64(0), int64(10)},
+		{1.0, nil},
+	}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected columns: %v", got)
+	}
+}
+
+// Ensure a row can be projected onto a subset of its columns.
+func TestRow_Project(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "idle", "user"},
+		Values:  [][]interface{}{{int64(0), 90.0, 5.0}, {int64(10), 80.0, 15.0}},
+	}
+
+	other, err := r.Project("user", "time")
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other, &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"user", "time"},
+		Values:  [][]interface{}{{5.0, int64(0)}, {15.0, int64(10)}},
+	}) {
+		t.Fatalf("unexpected row: %+v", other)
+	}
+
+	if _, err := r.Project("system"); err == nil {
+		t.Fatal("expected error for missing column")
+	}
+}
+
+// Ensure a wide row is split into rows of limited width that each keep the time column.
+func TestRow_SplitColumns(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"idle", "time", "user", "system", "iowait"},
+		Values:  [][]interface{}{{90.0, int64(0), 5.0, 3.0, 2.0}, {80.0, int64(10), 15.0, 4.0, 1.0}},
+	}
+
+	rows := r.SplitColumns(3)
+	exp := []*models.Row{
+		{
+			Name:    "cpu",
+			Tags:    map[string]string{"host": "a"},
+			Columns: []string{"time", "idle", "user"},
+			Values:  [][]interface{}{{int64(0), 90.0, 5.0}, {int64(10), 80.0, 15.0}},
+		},
+		{
+			Name:    "cpu",
+			Tags:    map[string]string{"host": "a"},
+			Columns: []string{"time", "system", "iowait"},
+			Values:  [][]interface{}{{int64(0), 3.0, 2.0}, {int64(10), 4.0, 1.0}},
+		},
+	}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+
+	if rows := r.SplitColumns(5); len(rows) != 1 || rows[0] != r {
+		t.Fatalf("expected row to be returned unsplit: %+v", rows)
+	}
+
+	r = &models.Row{Columns: []string{"a", "b", "c"}, Values: [][]interface{}{{1, 2, 3}}}
+	if rows := r.SplitColumns(2); len(rows) != 2 || !reflect.DeepEqual(rows[1].Columns, []string{"c"}) {
+		t.Fatalf("unexpected rows without time column: %+v", rows)
+	}
+}
+
+// Ensure numeric aggregates can be computed over a column.
+func TestRow_Aggregate(t *testing.T) {
+	r := &models.Row{
+		Name:    "cpu",
+		Columns: []string{"time", "value", "host"},
+		Values: [][]interface{}{
+			{int64(0), 1.0, "a"},
+			{int64(10), nil, "b"},
+			{int64(20), int64(5), "c"},
+		},
+	}
+
+	for _, tt := range []struct {
+		fn  models.AggFunc
+		exp float64
+	}{
+		{fn: models.AggSum, exp: 6},
+		{fn: models.AggMean, exp: 3},
+		{fn: models.AggMin, exp: 1},
+		{fn: models.AggMax, exp: 5},
+		{fn: models.AggCount, exp: 2},
+	} {
+		if v, err := r.Aggregate("value", tt.fn); err != nil {
+			t.Fatalf("%d: %s", tt.fn, err)
+		} else if v != tt.exp {
+			t.Fatalf("%d: unexpected value: %v", tt.fn, v)
+		}
+	}
+
+	if _, err := r.Aggregate("host", models.AggSum); err == nil {
+		t.Fatal("expected error for non-numeric column")
+	} else if _, err := r.Aggregate("usage", models.AggSum); err == nil {
+		t.Fatal("expected error for missing column")
+	}
+}
+
+// Ensure columns are looked up exactly or without regard to case.
+func TestRow_ColumnIndex(t *testing.T) {
+	r := &models.Row{Columns: []string{"time", "Value", "VALUE", "host"}}
+
+	if i := r.ColumnIndex("value"); i != -1 {
+		t.Fatalf("unexpected exact index: %d", i)
+	} else if i := r.ColumnIndex("VALUE"); i != 2 {
+		t.Fatalf("unexpected exact index: %d", i)
+	} else if i := r.ColumnIndexFold("value"); i != 1 {
+		t.Fatalf("unexpected case-insensitive index: %d", i)
+	} else if i := r.ColumnIndexFold("HOST"); i != 3 {
+		t.Fatalf("unexpected case-insensitive index: %d", i)
+	} else if i := r.ColumnIndexFold("region"); i != -1 {
+		t.Fatalf("unexpected case-insensitive index: %d", i)
+	}
+}
+
+// Ensure tags are normalized and colliding keys merged.
+func TestRow_NormalizeTags(t *testing.T) {
+	tags := map[string]string{" Host": "Server01 ", "host": "server02", "Region": "West"}
+	r := &models.Row{Name: "cpu", Tags: tags}
+
+	opts := models.NormalizeOptions{TrimSpace: true, LowercaseKeys: true, LowercaseValues: true}
+	r.NormalizeTags(opts)
+	exp := map[string]string{"host": "server01", "region": "west"}
+	if !reflect.DeepEqual(r.Tags, exp) {
+		t.Fatalf("unexpected tags: %v", r.Tags)
+	} else if len(tags) != 3 {
+		t.Fatal("expected original tags to be untouched")
+	}
+
+	r.NormalizeTags(opts)
+	if !reflect.DeepEqual(r.Tags, exp) {
+		t.Fatalf("unexpected tags after second normalization: %v", r.Tags)
+	}
+}
+
+// Ensure series IDs are stable and distinct across names and tag sets.
+func TestRow_SeriesID(t *testing.T) {
+	a := &models.Row{Name: "cpu", Tags: map[string]string{"host": "a", "region": "west"}}
+	b := &models.Row{Name: "cpu", Tags: map[string]string{"region": "west", "host": "a"}, Columns: []string{"value"}}
+	if a.SeriesID() != b.SeriesID() {
+		t.Fatal("expected rows of the same series to have the same ID")
+	}
+
+	ids := make(map[uint64]string)
+	for _, name := range []string{"cpu", "mem", "disk", "cpu0", "c"} {
+		for _, tags := range []map[string]string{
+			nil,
+			{"host": "a"},
+			{"host": "b"},
+			{"hos": "ta"},
+			{"host": "a", "region": "west"},
+			{"hosta": ""},
+			{"pu": ""},
+		} {
+			r := &models.Row{Name: name, Tags: tags}
+			key := fmt.Sprintf("%s%v", name, tags)
+			if other, ok := ids[r.SeriesID()]; ok {
+				t.Fatalf("series ID collision between %s and %s", key, other)
+			}
+			ids[r.SeriesID()] = key
+		}
+	}
+}
+
+// Ensure rows can be filtered by glob and regex tag patterns.
+func TestRows_FilterByTagPattern(t *testing.T) {
+	rows := models.Rows{
+		{Name: "cpu", Tags: map[string]string{"host": "web-01"}},
+		{Name: "cpu", Tags: map[string]string{"host": "db-01"}},
+		{Name: "cpu", Tags: map[string]string{"host": "web.02"}},
+		{Name: "cpu"},
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		n       int
+	}{
+		{pattern: "web-*", n: 1},
+		{pattern: "*-01", n: 2},
+		{pattern: "web?0?", n: 2},
+		{pattern: "/^web/", n: 2},
+		{pattern: "*", n: 3},
+	} {
+		other, err := rows.FilterByTagPattern("host", tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.pattern, err)
+		} else if len(other) != tt.n {
+			t.Fatalf("%s: unexpected number of rows: %d", tt.pattern, len(other))
+		}
+	}
+
+	if _, err := rows.FilterByTagPattern("host", "/[/"); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+// Ensure tag values are rewritten consistently without touching shared maps.
+func TestRows_ReplaceTagValues(t *testing.T) {
+	shared := map[string]string{"host": "web-01", "region": "west"}
+	rows := models.Rows{
+		{Name: "cpu", Tags: shared},
+		{Name: "mem", Tags: shared},
+		{Name: "cpu", Tags: map[string]string{"host": "db-01"}},
+		{Name: "cpu", Tags: map[string]string{"host": "other"}},
+		{Name: "cpu"},
+	}
+
+	rows.ReplaceTagValues("host", map[string]string{"web-01": "host-a", "db-01": "host-b"})
+
+	exp := []map[string]string{
+		{"host": "host-a", "region": "west"},
+		{"host": "host-a", "region": "west"},
+		{"host": "host-b"},
+		{"host": "other"},
+		nil,
+	}
+	for i, r := range rows {
+		if !reflect.DeepEqual(r.Tags, exp[i]) {
+			t.Fatalf("row %d: unexpected tags: %v", i, r.Tags)
+		}
+	}
+	if shared["host"] != "web-01" {
+		t.Fatalf("shared tags modified: %v", shared)
+	}
+}
+
+// Ensure rows are written as aligned tables.
+func TestRows_WriteTable(t *testing.T) {
+	rows := models.Rows{
+		{
+			Name:    "cpu",
+			Tags:    map[string]string{"region": "west", "host": "a"},
+			Columns: []string{"time", "value"},
+			Values:  [][]interface{}{{int64(0), 1.5}, {int64(10), nil}},
+		},
+		{
+			Name:    "mem",
+			Columns: []string{"time", "free"},
+			Values:  [][]interface{}{{int64(0), strings.Repeat("x", 70)}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := rows.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "name: cpu\n" +
+		"tags: host=a, region=west\n" +
+		"time value\n" +
+		"---- -----\n" +
+		"0    1.5\n" +
+		"10   \n" +
+		"\n" +
+		"name: mem\n" +
+		"time free\n" +
+		"---- ----\n" +
+		"0    " + strings.Repeat("x", 61) + "...\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("unexpected table:\n\ngot=%q\n\nexp=%q", got, exp)
+	}
+}
+
+// Ensure each value is written as a JSON object merging tags and columns.
+func TestRows_WriteNDJSON(t *testing.T) {
+	rows := models.Rows{
+		{
+			Name:    "cpu",
+			Tags:    map[string]string{"host": "a", "value": "tag"},
+			Columns: []string{"time", "value"},
+			Values:  [][]interface{}{{int64(0), 1.5}, {time.Unix(1, 5).UTC(), nil}},
+		},
+		{
+			Name:    "mem",
+			Columns: []string{"free"},
+			Values:  [][]interface{}{{int64(10)}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := rows.WriteNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `{"host":"a","time":"1970-01-01T00:00:00Z","value":1.5}` + "\n" +
+		`{"host":"a","time":"1970-01-01T00:00:01.000000005Z","value":null}` + "\n" +
+		`{"free":10}` + "\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("unexpected output:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+}
+
+// Ensure every consistency problem in a set of rows is reported.
+func TestRows_CheckConsistency(t *testing.T) {
+	rows := models.Rows{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{int64(0), 1.0}}},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}},
+	}
+	if errs := rows.CheckConsistency(); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	rows = append(rows,
+		&models.Row{Columns: []string{"time"}},
+		&models.Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time"}, Values: [][]interface{}{{int64(0), 1.0}}},
+	)
+	if errs := rows.CheckConsistency(); len(errs) != 4 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+// Ensure rows are concatenated in order and column drift is detected.
+func TestConcatRows(t *testing.T) {
+	a := &models.Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}}
+	b := &models.Row{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "idle"}}
+	c := &models.Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}}
+
+	rows, err := models.ConcatRows(models.Rows{a, b}, models.Rows{c})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rows, models.Rows{a, b, c}) {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+
+	c.Columns = []string{"time", "idle"}
+	if _, err := models.ConcatRows(models.Rows{a, b}, models.Rows{c}); err != models.ErrColumnMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure rows can be built programmatically and inconsistencies are reported.
+func TestRowBuilder(t *testing.T) {
+	r, err := models.NewRowBuilder().
+		SetName("cpu").
+		AddTag("host", "a").
+		SetColumns("time", "value").
+		AddValues(int64(0), 1.0).
+		AddValues(int64(10), 2.0).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(r, &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "value"},
+		Values:  [][]interface{}{{int64(0), 1.0}, {int64(10), 2.0}},
+	}) {
+		t.Fatalf("unexpected row: %+v", r)
+	}
+
+	// Rows already built are not affected by later changes to the builder.
+	b := models.NewRowBuilder().SetName("cpu").AddTag("host", "a").SetColumns("time", "value").AddValues(int64(0), 1.0)
+	first, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.AddTag("host", "b").AddTag("region", "west").AddValues(int64(10), 2.0)
+	if second, err := b.Build(); err != nil {
+		t.Fatal(err)
+	} else if len(second.Values) != 2 || second.Tags["host"] != "b" {
+		t.Fatalf("unexpected second row: %+v", second)
+	}
+	if !reflect.DeepEqual(first, &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "value"},
+		Values:  [][]interface{}{{int64(0), 1.0}},
+	}) {
+		t.Fatalf("built row modified by builder: %+v", first)
+	}
+
+	if _, err := models.NewRowBuilder().SetName("cpu").SetColumns("time", "value").AddValues(int64(0)).Build(); err == nil {
+		t.Fatal("expected error for mismatched values")
+	}
+	if _, err := models.NewRowBuilder().SetColumns("time").AddValues(int64(0)).SetColumns("value").Build(); err == nil {
+		t.Fatal("expected error for columns set after values")
+	}
+}
+
+// Ensure the checksum depends on the content of the rows but not their order.
+func TestRows_Checksum(t *testing.T) {
+	cpu := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "value"},
+		Values:  [][]interface{}{{time.Unix(0, 0), 1.5}, {time.Unix(10, 0), nil}},
+	}
+	mem := &models.Row{
+		Name:    "mem",
+		Columns: []string{"time", "free"},
+		Values:  [][]interface{}{{time.Unix(0, 0), int64(10)}},
+	}
+
+	sum := models.Rows{cpu, mem}.Checksum()
+	if other := (models.Rows{mem, cpu}).Checksum(); other != sum {
+		t.Fatal("expected checksum to not depend on row order")
+	}
+
+	changed := *mem
+	changed.Values = [][]interface{}{{time.Unix(0, 0), float64(10)}}
+	if other := (models.Rows{cpu, &changed}).Checksum(); other == sum {
+		t.Fatal("expected checksum to depend on value types")
+	}
+
+	changed = *mem
+	changed.Tags = map[string]string{"host": "a"}
+	if other := (models.Rows{cpu, &changed}).Checksum(); other == sum {
+		t.Fatal("expected checksum to depend on tags")
+	}
+}
+
+// Ensure the iterator walks the values of every row in order.
+func TestRows_Iterator(t *testing.T) {
+	rows := models.Rows{
+		{Name: "cpu", Values: [][]interface{}{{1}, {2}}},
+		{Name: "disk"},
+		nil,
+		{Name: "mem", Values: [][]interface{}{{3}}},
+	}
+
+	type value struct {
+		series int
+		values []interface{}
+	}
+	var got []value
+	itr := rows.Iterator()
+	for {
+		i, values, ok := itr.Next()
+		if !ok {
+			break
+		}
+		got = append(got, value{i, values})
+	}
+
+	exp := []value{{0, []interface{}{1}}, {0, []interface{}{2}}, {3, []interface{}{3}}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values: %v", got)
+	}
+	if _, _, ok := itr.Next(); ok {
+		t.Fatal("expected exhausted iterator")
+	}
+}
+
+// Ensure partial rows of interleaved series are joined in arrival order.
+func TestStitchPartials(t *testing.T) {
+	in := make(chan *models.Row)
+	go func() {
+		defer close(in)
+		for _, r := range []*models.Row{
+			{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 1.0}}, Partial: true},
+			{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 2.0}}, Partial: true},
+			{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{2, 3.0}}, Partial: true},
+			{Name: "mem", Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 4.0}}},
+			{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{2, 5.0}}},
+			{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{3, 6.0}}},
+			{Name: "disk", Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 7.0}}, Partial: true},
+		} {
+			in <- r
+		}
+	}()
+
+	var got models.Rows
+	for r := range models.StitchPartials(in) {
+		got = append(got, r)
+	}
+
+	exp := models.Rows{
+		{Name: "mem", Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 4.0}}},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 2.0}, {2, 5.0}}},
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 1.0}, {2, 3.0}, {3, 6.0}}},
+		{Name: "disk", Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 7.0}}, Partial: true},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+}
@@ -0,0 +1,47 @@
+package monitor
+
+import "sync"
+
+// FieldKind describes how the values of a statistic field combine when
+// statistics of the same name are rolled up.
+type FieldKind int
+
+const (
+	// FieldUnknown is the kind of fields that haven't been registered.
+	FieldUnknown FieldKind = iota
+
+	// FieldCounter is a cumulative count. Counters are summed.
+	FieldCounter
+
+	// FieldGauge is a point-in-time measurement. Gauges are averaged.
+	FieldGauge
+)
+
+var fieldKinds = struct {
+	mu    sync.RWMutex
+	kinds map[string]map[string]FieldKind
+}{kinds: make(map[string]map[string]FieldKind)}
+
+// RegisterFieldKinds declares the kinds of the fields of the statistics with
+// the given name. Kinds registered earlier for the same fields are replaced.
+func RegisterFieldKinds(name string, kinds map[string]FieldKind) {
+	fieldKinds.mu.Lock()
+	defer fieldKinds.mu.Unlock()
+
+	m := fieldKinds.kinds[name]
+	if m == nil {
+		m = make(map[string]FieldKind, len(kinds))
+		fieldKinds.kinds[name] = m
+	}
+	for field, kind := range kinds {
+		m[field] = kind
+	}
+}
+
+// FieldKind returns the registered kind of the named field of the statistic,
+// or FieldUnknown if none was registered.
+func (s *Statistic) FieldKind(field string) FieldKind {
+	fieldKinds.mu.RLock()
+	defer fieldKinds.mu.RUnlock()
+	return fieldKinds.kinds[s.Name][field]
+}
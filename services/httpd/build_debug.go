@@ -0,0 +1,7 @@
+// +build debug
+
+package httpd
+
+func init() {
+	buildTags = append(buildTags, "debug")
+}
@@ -1,5 +1,12 @@
 package httpd
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/influxdata/influxdb/toml"
+)
+
 const (
 	// DefaultBindAddress is the default address to bind to.
 	DefaultBindAddress = ":8086"
@@ -11,6 +18,20 @@ const (
 	DefaultBindSocket = "/var/run/influxdb.sock"
 )
 
+// ExpvarStyle determines the whitespace of the JSON served by /debug/vars.
+type ExpvarStyle string
+
+const (
+	// ExpvarStyleDefault writes each top-level entry on its own line.
+	ExpvarStyleDefault ExpvarStyle = ""
+
+	// ExpvarStyleCompact writes the whole object on a single line.
+	ExpvarStyleCompact ExpvarStyle = "compact"
+
+	// ExpvarStylePretty indents every level of the object.
+	ExpvarStylePretty ExpvarStyle = "pretty"
+)
+
 // Config represents a configuration for a HTTP service.
 type Config struct {
 	Enabled            bool   `toml:"enabled"`
@@ -28,6 +49,22 @@ type Config struct {
 	Realm              string `toml:"realm"`
 	UnixSocketEnabled  bool   `toml:"unix-socket-enabled"`
 	BindSocket         string `toml:"bind-socket"`
+
+	// DebugCORSAllowedOrigins lists the origins allowed to make cross-origin
+	// requests to the /debug endpoints. "*" allows any origin. Empty disables
+	// CORS for the debug endpoints.
+	DebugCORSAllowedOrigins []string `toml:"debug-cors-allowed-origins"`
+
+	// StatsCacheTTL is how long the statistics served by /debug/vars are
+	// cached. Zero disables caching.
+	StatsCacheTTL toml.Duration `toml:"stats-cache-ttl"`
+
+	// ExpvarStyle is the whitespace style of the JSON served by /debug/vars.
+	ExpvarStyle ExpvarStyle `toml:"expvar-style"`
+
+	// GoroutineSampleInterval is how often the number of goroutines is
+	// sampled for /debug/goroutines/count. Zero disables sampling.
+	GoroutineSampleInterval toml.Duration `toml:"goroutine-sample-interval"`
 }
 
 // NewConfig returns a new Config with default settings.
@@ -45,3 +82,16 @@ func NewConfig() Config {
 		BindSocket:        DefaultBindSocket,
 	}
 }
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	switch c.ExpvarStyle {
+	case ExpvarStyleDefault, ExpvarStyleCompact, ExpvarStylePretty:
+	default:
+		return fmt.Errorf("invalid http expvar-style: %q", c.ExpvarStyle)
+	}
+	if c.GoroutineSampleInterval < 0 {
+		return errors.New("http goroutine-sample-interval must not be negative")
+	}
+	return nil
+}
@@ -53,3 +53,21 @@ func TestConfig_WriteTracing(t *testing.T) {
 		t.Fatalf("write tracing was not set")
 	}
 }
+
+func TestConfig_Validate(t *testing.T) {
+	c := httpd.NewConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	c.ExpvarStyle = "sparse"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected validation error for expvar style")
+	}
+
+	c = httpd.NewConfig()
+	c.GoroutineSampleInterval = -1
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected validation error for goroutine sample interval")
+	}
+}
@@ -0,0 +1,91 @@
+package httpd
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// goroutineHistorySize is the number of goroutine count samples kept.
+const goroutineHistorySize = 60
+
+// goroutineSample is the number of goroutines at a point in time.
+type goroutineSample struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+// goroutineSampler periodically records the number of goroutines, keeping
+// the most recent goroutineHistorySize samples.
+type goroutineSampler struct {
+	mu      sync.Mutex
+	samples []goroutineSample
+	next    int
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// open starts sampling every interval.
+func (s *goroutineSampler) open(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing != nil {
+		return
+	}
+	s.closing = make(chan struct{})
+
+	s.wg.Add(1)
+	go s.run(interval, s.closing)
+}
+
+// close stops sampling. The samples recorded so far are kept.
+func (s *goroutineSampler) close() {
+	s.mu.Lock()
+	if s.closing == nil {
+		s.mu.Unlock()
+		return
+	}
+	close(s.closing)
+	s.closing = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *goroutineSampler) run(interval time.Duration, closing chan struct{}) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.record(goroutineSample{Time: time.Now().UTC(), Count: runtime.NumGoroutine()})
+
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record adds a sample, replacing the oldest once the history is full.
+func (s *goroutineSampler) record(sample goroutineSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < goroutineHistorySize {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % goroutineHistorySize
+}
+
+// history returns the recorded samples, oldest first.
+func (s *goroutineSampler) history() []goroutineSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := make([]goroutineSample, 0, len(s.samples))
+	a = append(a, s.samples[s.next:]...)
+	return append(a, s.samples[:s.next]...)
+}
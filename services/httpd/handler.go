@@ -1,6 +1,7 @@
 package httpd
 
 import (
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
@@ -8,13 +9,19 @@ import (
 	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -60,11 +67,16 @@ type Route struct {
 	Gzipped        bool
 	LoggingEnabled bool
 	HandlerFunc    interface{}
+
+	// DebugOnly is set for routes that are only registered in builds with
+	// the debug tag. It is reported by /debug/routes.
+	DebugOnly bool
 }
 
 // Handler represents an HTTP handler for the InfluxDB server.
 type Handler struct {
 	mux     *pat.PatternServeMux
+	routes  []Route
 	Version string
 
 	MetaClient interface {
@@ -84,20 +96,37 @@ type Handler struct {
 
 	QueryExecutor *influxql.QueryExecutor
 
-	Monitor interface {
-		Statistics(tags map[string]string) ([]*monitor.Statistic, error)
-	}
+	Monitor Monitor
+
+	// StatSerializer, if set, writes the statistics served by /debug/vars and
+	// DumpVarsTo in place of the expvar JSON format.
+	StatSerializer StatSerializer
 
 	PointsWriter interface {
 		WritePoints(database, retentionPolicy string, consistencyLevel models.ConsistencyLevel, points []models.Point) error
 	}
 
-	Config    *Config
-	Logger    zap.Logger
-	CLFLogger *log.Logger
-	stats     *Statistics
+	Config      *Config
+	Logger      zap.Logger
+	CLFLogger   *log.Logger
+	stats       *Statistics
+	statsCache  statsCache
+	statsDeltas statsDeltas
+	goroutines  goroutineSampler
+
+	// mu protects the pattern mux, the registered routes and debug actions.
+	mu           sync.RWMutex
+	debugActions map[string]DebugAction
+
+	// blockProfiling is set to 1 while block profiling is enabled.
+	blockProfiling int32
 }
 
+// DebugAction is a named maintenance operation that can be invoked through
+// the /debug/batch endpoint. params holds the raw JSON parameters passed by
+// the caller and the returned value is encoded as the action's result.
+type DebugAction func(params json.RawMessage) (interface{}, error)
+
 // NewHandler returns a new instance of handler with routes.
 func NewHandler(c Config) *Handler {
 	h := &Handler{
@@ -106,50 +135,95 @@ func NewHandler(c Config) *Handler {
 		Logger:    zap.New(zap.NullEncoder()),
 		CLFLogger: log.New(os.Stderr, "[httpd] ", 0),
 		stats:     &Statistics{},
+		debugActions: map[string]DebugAction{
+			"gc": func(json.RawMessage) (interface{}, error) {
+				debug.FreeOSMemory()
+				return nil, nil
+			},
+		},
 	}
 
-	h.AddRoutes([]Route{
+	if err := h.AddRoutes([]Route{
 		Route{
 			"query-options", // Satisfy CORS checks.
-			"OPTIONS", "/query", false, true, h.serveOptions,
+			"OPTIONS", "/query", false, true, h.serveOptions, false,
 		},
 		Route{
 			"query", // Query serving route.
-			"GET", "/query", true, true, h.serveQuery,
+			"GET", "/query", true, true, h.serveQuery, false,
 		},
 		Route{
 			"query", // Query serving route.
-			"POST", "/query", true, true, h.serveQuery,
+			"POST", "/query", true, true, h.serveQuery, false,
 		},
 		Route{
 			"write-options", // Satisfy CORS checks.
-			"OPTIONS", "/write", false, true, h.serveOptions,
+			"OPTIONS", "/write", false, true, h.serveOptions, false,
 		},
 		Route{
 			"write", // Data-ingest route.
-			"POST", "/write", true, true, h.serveWrite,
+			"POST", "/write", true, true, h.serveWrite, false,
 		},
 		Route{ // Ping
 			"ping",
-			"GET", "/ping", false, true, h.servePing,
+			"GET", "/ping", false, true, h.servePing, false,
 		},
 		Route{ // Ping
 			"ping-head",
-			"HEAD", "/ping", false, true, h.servePing,
+			"HEAD", "/ping", false, true, h.servePing, false,
 		},
 		Route{ // Ping w/ status
 			"status",
-			"GET", "/status", false, true, h.serveStatus,
+			"GET", "/status", false, true, h.serveStatus, false,
 		},
 		Route{ // Ping w/ status
 			"status-head",
-			"HEAD", "/status", false, true, h.serveStatus,
+			"HEAD", "/status", false, true, h.serveStatus, false,
+		},
+		Route{ // Reset statistics
+			"debug-vars-reset",
+			"POST", "/debug/vars/reset", false, true, h.serveExpvarReset, false,
+		},
+		Route{ // Statistics bundle
+			"debug-vars-bundle",
+			"GET", "/debug/vars/bundle", false, true, h.serveExpvarBundle, false,
+		},
+		Route{ // Registered routes
+			"debug-routes",
+			"GET", "/debug/routes", true, true, h.serveRoutes, false,
 		},
-	}...)
+		Route{ // Build information
+			"debug-build",
+			"GET", "/debug/build", true, true, h.serveBuild, false,
+		},
+		Route{ // Batch debug actions
+			"debug-batch",
+			"POST", "/debug/batch", true, true, h.serveDebugBatch, false,
+		},
+		Route{ // Goroutine count
+			"debug-goroutines-count",
+			"GET", "/debug/goroutines/count", false, true, h.serveGoroutineCount, false,
+		},
+	}...); err != nil {
+		panic(err)
+	}
 
 	return h
 }
 
+// Open starts the background tasks of the handler, such as sampling the
+// number of goroutines if it is enabled.
+func (h *Handler) Open() {
+	if h.Config.GoroutineSampleInterval > 0 {
+		h.goroutines.open(time.Duration(h.Config.GoroutineSampleInterval))
+	}
+}
+
+// Close stops the background tasks of the handler.
+func (h *Handler) Close() {
+	h.goroutines.close()
+}
+
 // Statistics maintains statistics for the httpd service.
 type Statistics struct {
 	Requests                     int64
@@ -201,34 +275,135 @@ func (h *Handler) Statistics(tags map[string]string) []models.Statistic {
 	}}
 }
 
-// AddRoutes sets the provided routes on the handler.
-func (h *Handler) AddRoutes(routes ...Route) {
-	for _, r := range routes {
-		var handler http.Handler
+// AddRoutes sets the provided routes on the handler. An error is returned,
+// and none of the routes are added, if a route is already registered for the
+// method and pattern of one of them.
+func (h *Handler) AddRoutes(routes ...Route) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.addRoutes(routes)
+}
 
-		// If it's a handler func that requires authorization, wrap it in authentication
-		if hf, ok := r.HandlerFunc.(func(http.ResponseWriter, *http.Request, *meta.UserInfo)); ok {
-			handler = authenticate(hf, h, h.Config.AuthEnabled)
+// addRoutes registers the routes after checking them for conflicts. The
+// caller must hold the lock.
+func (h *Handler) addRoutes(routes []Route) error {
+	builtin := h.builtinRoutes()
+	for i, r := range routes {
+		if containsRoute(h.routes, r) || containsRoute(builtin, r) || containsRoute(routes[:i], r) {
+			return fmt.Errorf("route already registered: %s %s", r.Method, r.Pattern)
 		}
+	}
 
-		// This is a normal handler signature and does not require authentication
-		if hf, ok := r.HandlerFunc.(func(http.ResponseWriter, *http.Request)); ok {
-			handler = http.HandlerFunc(hf)
-		}
+	for _, r := range routes {
+		h.mux.Add(r.Method, r.Pattern, h.routeHandler(r))
+		h.routes = append(h.routes, r)
+	}
+	return nil
+}
+
+// AddHandler registers an ad-hoc handler for the method and pattern without
+// requiring a build with the debug tag. The handler is served behind
+// authentication and, when authentication is enabled, only to admin users.
+// It is listed by /debug/routes and can be removed with RemoveRoutes. An
+// error is returned if a route is already registered for the method and
+// pattern.
+func (h *Handler) AddHandler(method, pattern string, handler http.Handler) error {
+	return h.AddRoutes(h.adHocRoute(method, pattern, handler))
+}
+
+// AddDebugHandler registers an ad-hoc handler like AddHandler, marking it as
+// only registered in builds with the debug tag.
+func (h *Handler) AddDebugHandler(method, pattern string, handler http.Handler) error {
+	r := h.adHocRoute(method, pattern, handler)
+	r.DebugOnly = true
+	return h.AddRoutes(r)
+}
+
+// adHocRoute returns the route serving an ad-hoc handler.
+func (h *Handler) adHocRoute(method, pattern string, handler http.Handler) Route {
+	return Route{
+		Name:           "ad-hoc",
+		Method:         method,
+		Pattern:        pattern,
+		LoggingEnabled: true,
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request, user *meta.UserInfo) {
+			if !h.authorizeDebug(w, user) {
+				return
+			}
+			handler.ServeHTTP(w, r)
+		},
+	}
+}
 
-		handler = h.responseWriter(handler)
-		if r.Gzipped {
-			handler = gzipFilter(handler)
+// RemoveRoutes unregisters the routes matching the method and pattern of each
+// given route. Routes that aren't registered are ignored.
+func (h *Handler) RemoveRoutes(routes ...Route) {
+	h.ReplaceRoutes(routes, nil)
+}
+
+// ReplaceRoutes unregisters the old routes and registers the new ones in a
+// single step, so requests never observe a partially updated set of routes.
+func (h *Handler) ReplaceRoutes(old, new []Route) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The pattern mux doesn't support removal, so it is rebuilt from the
+	// remaining routes.
+	var routes []Route
+	for _, r := range h.routes {
+		if !containsRoute(old, r) {
+			routes = append(routes, r)
 		}
-		handler = cors(handler)
-		handler = requestID(handler)
-		if h.Config.LogEnabled && r.LoggingEnabled {
-			handler = h.logging(handler, r.Name)
+	}
+	routes = append(routes, new...)
+
+	h.mux = pat.New()
+	for _, r := range routes {
+		h.mux.Add(r.Method, r.Pattern, h.routeHandler(r))
+	}
+	h.routes = routes
+}
+
+// containsRoute returns true if a has a route with the method and pattern of r.
+func containsRoute(a []Route, r Route) bool {
+	for _, other := range a {
+		if other.Method == r.Method && other.Pattern == r.Pattern {
+			return true
 		}
-		handler = h.recovery(handler, r.Name) // make sure recovery is always last
+	}
+	return false
+}
+
+// routeHandler wraps the route's handler function with authentication,
+// logging and the other filters enabled for it.
+func (h *Handler) routeHandler(r Route) http.Handler {
+	var handler http.Handler
 
-		h.mux.Add(r.Method, r.Pattern, handler)
+	// If it's a handler func that requires authorization, wrap it in authentication
+	if hf, ok := r.HandlerFunc.(func(http.ResponseWriter, *http.Request, *meta.UserInfo)); ok {
+		handler = authenticate(hf, h, h.Config.AuthEnabled)
+	}
+
+	// This is a normal handler signature and does not require authentication
+	if hf, ok := r.HandlerFunc.(func(http.ResponseWriter, *http.Request)); ok {
+		handler = http.HandlerFunc(hf)
+	}
+
+	handler = h.responseWriter(handler)
+	if r.Gzipped {
+		handler = gzipFilter(handler)
+	}
+	// CORS for the debug endpoints is handled by ServeHTTP, and only for the
+	// configured origins.
+	if !strings.HasPrefix(r.Pattern, "/debug/") {
+		handler = cors(handler)
+	}
+	handler = requestID(handler)
+	if h.Config.LogEnabled && r.LoggingEnabled {
+		handler = h.logging(handler, r.Name)
 	}
+	handler = h.recovery(handler, r.Name) // make sure recovery is always last
+	return handler
 }
 
 // ServeHTTP responds to HTTP request to the handler.
@@ -241,7 +416,9 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Add version header to all InfluxDB requests.
 	w.Header().Add("X-Influxdb-Version", h.Version)
 
-	if strings.HasPrefix(r.URL.Path, "/debug/pprof") && h.Config.PprofEnabled {
+	if strings.HasPrefix(r.URL.Path, "/debug/") && h.serveDebugCORS(w, r) {
+		// Preflight request has been handled.
+	} else if strings.HasPrefix(r.URL.Path, "/debug/pprof") && h.Config.PprofEnabled {
 		switch r.URL.Path {
 		case "/debug/pprof/cmdline":
 			pprof.Cmdline(w, r)
@@ -249,13 +426,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			pprof.Profile(w, r)
 		case "/debug/pprof/symbol":
 			pprof.Symbol(w, r)
+		case "/debug/pprof/block":
+			if atomic.LoadInt32(&h.blockProfiling) == 0 {
+				http.Error(w, "block profiling is not enabled", http.StatusNotFound)
+				break
+			}
+			pprof.Index(w, r)
 		default:
 			pprof.Index(w, r)
 		}
-	} else if strings.HasPrefix(r.URL.Path, "/debug/vars") {
+	} else if r.URL.Path == "/debug/vars" {
 		h.serveExpvar(w, r)
 	} else {
-		h.mux.ServeHTTP(w, r)
+		h.mu.RLock()
+		mux := h.mux
+		h.mu.RUnlock()
+		mux.ServeHTTP(w, r)
 	}
 
 	atomic.AddInt64(&h.stats.RequestDuration, time.Since(start).Nanoseconds())
@@ -313,6 +499,9 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 
 	epoch := strings.TrimSpace(r.FormValue("epoch"))
 
+	// Report whether the response is incomplete at the top level, if requested.
+	partialSummary := r.FormValue("partial_summary") == "true"
+
 	p := influxql.NewParser(qr)
 	db := r.FormValue("db")
 
@@ -452,9 +641,11 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 
 		// Write out result immediately if chunked.
 		if chunked {
-			n, _ := rw.WriteResponse(Response{
-				Results: []*influxql.Result{r},
-			})
+			chunk := Response{Results: []*influxql.Result{r}}
+			if partialSummary {
+				chunk.Partial = chunk.anyPartial()
+			}
+			n, _ := rw.WriteResponse(chunk)
 			atomic.AddInt64(&h.stats.QueryRequestBytesTransmitted, int64(n))
 			w.(http.Flusher).Flush()
 			continue
@@ -544,6 +735,9 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 
 	// If it's not chunked we buffered everything in memory, so write it out
 	if !chunked {
+		if partialSummary {
+			resp.Partial = resp.anyPartial()
+		}
 		n, _ := rw.WriteResponse(resp)
 		atomic.AddInt64(&h.stats.QueryRequestBytesTransmitted, int64(n))
 	}
@@ -688,6 +882,68 @@ func (h *Handler) serveOptions(w http.ResponseWriter, r *http.Request) {
 	h.writeHeader(w, http.StatusNoContent)
 }
 
+// buildTags holds the build tags the binary was compiled with that affect the
+// handler. Files built with those tags register them from init.
+var buildTags []string
+
+// buildInfo is the response of the /debug/build endpoint.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	GoVersion string   `json:"goVersion"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	BuildTags []string `json:"buildTags"`
+	Debug     bool     `json:"debug"`
+}
+
+// serveBuild returns the version of the server and how it was built.
+func (h *Handler) serveBuild(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{
+		Version:   h.Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		BuildTags: []string{},
+	}
+	for _, tag := range buildTags {
+		info.BuildTags = append(info.BuildTags, tag)
+		if tag == "debug" {
+			info.Debug = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.Marshal(info)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// goroutineCount is the response of the /debug/goroutines/count endpoint.
+type goroutineCount struct {
+	Count   int               `json:"count"`
+	History []goroutineSample `json:"history,omitempty"`
+}
+
+// serveGoroutineCount returns the current number of goroutines along with
+// the recent samples, if sampling is enabled.
+func (h *Handler) serveGoroutineCount(w http.ResponseWriter, r *http.Request) {
+	resp := goroutineCount{
+		Count:   runtime.NumGoroutine(),
+		History: h.goroutines.history(),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.Marshal(resp)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
 // servePing returns a simple response to let the client know the server is running.
 func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&h.stats.PingRequests, 1)
@@ -729,72 +985,573 @@ func convertToEpoch(r *influxql.Result, epoch string) {
 
 // serveExpvar serves internal metrics in /debug/vars format over HTTP.
 func (h *Handler) serveExpvar(w http.ResponseWriter, r *http.Request) {
-	// Retrieve statistics from the monitor.
-	stats, err := h.Monitor.Statistics(nil)
+	// Retrieve statistics from the monitor, along with the process statistics.
+	stats, errs, err := h.statistics()
 	if err != nil {
 		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// Clients identifying themselves receive the change since their last scrape.
+	if client := r.Header.Get("X-Influxdb-Stats-Client"); client != "" {
+		stats = h.statsDeltas.deltas(client, stats, time.Now())
+	}
 
-	fmt.Fprintln(w, "{")
-	first := true
-	if val := expvar.Get("cmdline"); val != nil {
-		if !first {
-			fmt.Fprintln(w, ",")
+	// Roll up statistics sharing a name, summing counters and averaging gauges.
+	if r.FormValue("aggregate") == "true" {
+		stats = aggregateStatistics(stats)
+	}
+
+	ss := h.statSerializer(errs)
+	w.Header().Set("Content-Type", ss.ContentType())
+	if err := ss.Serialize(w, expvarStatistics(stats)); err != nil {
+		h.Logger.Info(fmt.Sprintf("failed to serialize statistics: %s", err))
+	}
+}
+
+// statSerializer returns the StatSerializer if one is set, or the expvar JSON
+// serializer, which lists errs under "_errors".
+func (h *Handler) statSerializer(errs []error) StatSerializer {
+	if h.StatSerializer != nil {
+		return h.StatSerializer
+	}
+	return expvarSerializer{style: h.Config.ExpvarStyle, errs: errs}
+}
+
+// statistics returns the monitor statistics, cached if configured, followed
+// by the process statistics. If the monitor is a PartialMonitor, the errors
+// of the statistics it couldn't collect are returned too.
+func (h *Handler) statistics() ([]*monitor.Statistic, []error, error) {
+	var m Monitor = h.Monitor
+	var errs []error
+	if ttl := time.Duration(h.Config.StatsCacheTTL); ttl > 0 {
+		stats, cerrs, err := h.statsCache.get(h.Monitor, ttl)
+		if err != nil {
+			return nil, nil, err
+		}
+		m, errs = staticMonitor(stats), cerrs
+	} else if m != nil {
+		stats, merrs, err := monitorStatistics(m)
+		if err != nil {
+			return nil, nil, err
 		}
-		first = false
-		fmt.Fprintf(w, "\"cmdline\": %s", val)
+		m, errs = staticMonitor(stats), merrs
 	}
-	if val := expvar.Get("memstats"); val != nil {
-		if !first {
-			fmt.Fprintln(w, ",")
+
+	stats, err := multiMonitor{m, runtimeMonitor{}}.Statistics(nil)
+	return stats, errs, err
+}
+
+// DumpVarsTo writes the current statistics to the file at path, in the same
+// format served by /debug/vars. The file is replaced atomically.
+func (h *Handler) DumpVarsTo(path string) error {
+	stats, errs, err := h.statistics()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := h.statSerializer(errs).Serialize(f, expvarStatistics(stats)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// DumpVarsOnSignal writes the current statistics to path, using DumpVarsTo,
+// every time the process receives one of the given signals. Calling the
+// returned function stops listening for the signals.
+func (h *Handler) DumpVarsOnSignal(path string, sig ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sig...)
+
+	go func() {
+		for {
+			select {
+			case <-c:
+				if err := h.DumpVarsTo(path); err != nil {
+					h.Logger.Info(fmt.Sprintf("failed to dump statistics to %s: %s", path, err))
+				}
+			case <-done:
+				return
+			}
 		}
-		first = false
-		fmt.Fprintf(w, "\"memstats\": %s", val)
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
 	}
+}
 
+// expvarStatistics returns the statistics keyed as they are in /debug/vars.
+// If several statistics have the same key, the last one is kept.
+func expvarStatistics(stats []*monitor.Statistic) map[string]*monitor.Statistic {
+	m := make(map[string]*monitor.Statistic, len(stats))
 	for _, s := range stats {
+		m[expvarKey(s)] = s
+	}
+	return m
+}
+
+// expvarKey returns the unique key of a statistic in the /debug/vars output.
+func expvarKey(s *monitor.Statistic) string {
+	// Very hackily create a unique key.
+	buf := bytes.NewBufferString(s.Name)
+	if path, ok := s.Tags["path"]; ok {
+		fmt.Fprintf(buf, ":%s", path)
+		if id, ok := s.Tags["id"]; ok {
+			fmt.Fprintf(buf, ":%s", id)
+		}
+	} else if bind, ok := s.Tags["bind"]; ok {
+		if proto, ok := s.Tags["proto"]; ok {
+			fmt.Fprintf(buf, ":%s", proto)
+		}
+		fmt.Fprintf(buf, ":%s", bind)
+	} else if database, ok := s.Tags["database"]; ok {
+		fmt.Fprintf(buf, ":%s", database)
+		if rp, ok := s.Tags["retention_policy"]; ok {
+			fmt.Fprintf(buf, ":%s", rp)
+			if name, ok := s.Tags["name"]; ok {
+				fmt.Fprintf(buf, ":%s", name)
+			}
+			if dest, ok := s.Tags["destination"]; ok {
+				fmt.Fprintf(buf, ":%s", dest)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// serveExpvarBundle serves the statistics as a zip archive holding one JSON
+// file per statistic name. Each file holds the statistics of that name keyed
+// as they are in /debug/vars. A manifest.json file at the root of the archive
+// lists each file along with its size and the time it was captured.
+func (h *Handler) serveExpvarBundle(w http.ResponseWriter, r *http.Request) {
+	stats, _, err := h.statistics()
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	captured := time.Now().UTC()
+
+	groups := make(map[string]map[string]*monitor.Statistic)
+	var names []string
+	for _, s := range stats {
+		if _, ok := groups[s.Name]; !ok {
+			groups[s.Name] = make(map[string]*monitor.Statistic)
+			names = append(names, s.Name)
+		}
+		groups[s.Name][expvarKey(s)] = s
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="vars.zip"`)
+
+	zw := zip.NewWriter(w)
+	var manifest []bundleFile
+	for _, name := range names {
+		b, err := json.MarshalIndent(groups[name], "", "  ")
+		if err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to encode %s statistics: %s", name, err))
+			continue
+		}
+
+		file := bundleFile{Name: name + ".json", Captured: captured, Size: len(b)}
+		if err := writeBundleFile(zw, file, b); err != nil {
+			h.Logger.Info(fmt.Sprintf("failed to write statistics bundle: %s", err))
+			return
+		}
+		manifest = append(manifest, file)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = writeBundleFile(zw, bundleFile{Name: "manifest.json", Captured: captured}, b)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		h.Logger.Info(fmt.Sprintf("failed to write statistics bundle: %s", err))
+	}
+}
+
+// bundleFile describes a file in a statistics bundle.
+type bundleFile struct {
+	Name     string    `json:"name"`
+	Captured time.Time `json:"captured"`
+	Size     int       `json:"size"`
+}
+
+// writeBundleFile adds a file holding b to the archive, with its
+// modification time set to the time it was captured.
+func writeBundleFile(zw *zip.Writer, file bundleFile, b []byte) error {
+	hdr := &zip.FileHeader{Name: file.Name, Method: zip.Deflate}
+	hdr.SetModTime(file.Captured)
+	f, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+// expvarFlushInterval is the number of statistics written to /debug/vars
+// between flushes.
+const expvarFlushInterval = 100
+
+// StatSerializer writes the statistics served by /debug/vars in a particular
+// format. The statistics are keyed as they are in the expvar JSON output.
+type StatSerializer interface {
+	// ContentType returns the media type of the serialized statistics.
+	ContentType() string
+
+	Serialize(w io.Writer, stats map[string]*monitor.Statistic) error
+}
+
+// expvarSerializer writes the statistics in the expvar JSON format.
+type expvarSerializer struct {
+	style ExpvarStyle
+	errs  []error
+}
+
+// ContentType returns the JSON media type.
+func (s expvarSerializer) ContentType() string { return "application/json; charset=utf-8" }
+
+// Serialize writes the statistics, sorted by key, with writeExpvar.
+func (s expvarSerializer) Serialize(w io.Writer, stats map[string]*monitor.Statistic) error {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	a := make([]*monitor.Statistic, len(keys))
+	for i, k := range keys {
+		a[i] = stats[k]
+	}
+	writeExpvar(w, a, s.errs, s.style)
+	return nil
+}
+
+// writeExpvar writes the statistics, along with the cmdline and memstats
+// expvar values, as a single JSON object in the given style. Any errors are
+// listed under "_errors". If w is an http.Flusher, it is flushed every
+// expvarFlushInterval statistics.
+func writeExpvar(w io.Writer, stats []*monitor.Statistic, errs []error, style ExpvarStyle) {
+	ew := &expvarWriter{w: w, style: style}
+	ew.begin()
+	if val := expvar.Get("cmdline"); val != nil {
+		ew.write("cmdline", []byte(val.String()))
+	}
+	if val := expvar.Get("memstats"); val != nil {
+		ew.write("memstats", []byte(val.String()))
+	}
+
+	// Flush periodically so clients receive large responses progressively.
+	flusher, _ := w.(http.Flusher)
+
+	for i, s := range stats {
+		if flusher != nil && i > 0 && i%expvarFlushInterval == 0 {
+			flusher.Flush()
+		}
+
+		// Map keys are marshaled in sorted order, so the tags and values of
+		// each statistic are stable between scrapes.
 		val, err := json.Marshal(s)
 		if err != nil {
 			continue
 		}
+		ew.write(expvarKey(s), bytes.TrimSpace(val))
+	}
 
-		// Very hackily create a unique key.
-		buf := bytes.NewBufferString(s.Name)
-		if path, ok := s.Tags["path"]; ok {
-			fmt.Fprintf(buf, ":%s", path)
-			if id, ok := s.Tags["id"]; ok {
-				fmt.Fprintf(buf, ":%s", id)
-			}
-		} else if bind, ok := s.Tags["bind"]; ok {
-			if proto, ok := s.Tags["proto"]; ok {
-				fmt.Fprintf(buf, ":%s", proto)
-			}
-			fmt.Fprintf(buf, ":%s", bind)
-		} else if database, ok := s.Tags["database"]; ok {
-			fmt.Fprintf(buf, ":%s", database)
-			if rp, ok := s.Tags["retention_policy"]; ok {
-				fmt.Fprintf(buf, ":%s", rp)
-				if name, ok := s.Tags["name"]; ok {
-					fmt.Fprintf(buf, ":%s", name)
-				}
-				if dest, ok := s.Tags["destination"]; ok {
-					fmt.Fprintf(buf, ":%s", dest)
-				}
-			}
+	if len(errs) > 0 {
+		a := make([]string, len(errs))
+		for i, err := range errs {
+			a[i] = err.Error()
+		}
+		if val, err := json.Marshal(a); err == nil {
+			ew.write("_errors", val)
+		}
+	}
+	ew.end()
+}
+
+// expvarWriter writes the entries of a JSON object in an ExpvarStyle.
+type expvarWriter struct {
+	w     io.Writer
+	style ExpvarStyle
+	first bool
+}
+
+// begin writes the opening of the object.
+func (ew *expvarWriter) begin() {
+	ew.first = true
+	if ew.style == ExpvarStyleCompact {
+		fmt.Fprint(ew.w, "{")
+		return
+	}
+	fmt.Fprintln(ew.w, "{")
+}
+
+// write writes a single entry of the object. val must be valid JSON.
+func (ew *expvarWriter) write(key string, val []byte) {
+	if !ew.first {
+		if ew.style == ExpvarStyleCompact {
+			fmt.Fprint(ew.w, ",")
+		} else {
+			fmt.Fprintln(ew.w, ",")
+		}
+	}
+	ew.first = false
+
+	switch ew.style {
+	case ExpvarStyleCompact:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, val); err == nil {
+			val = buf.Bytes()
+		}
+		fmt.Fprintf(ew.w, "%q:", key)
+	case ExpvarStylePretty:
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, val, "  ", "  "); err == nil {
+			val = buf.Bytes()
+		}
+		fmt.Fprintf(ew.w, "  %q: ", key)
+	default:
+		fmt.Fprintf(ew.w, "%q: ", key)
+	}
+	ew.w.Write(val)
+}
+
+// end writes the closing of the object.
+func (ew *expvarWriter) end() {
+	if ew.style == ExpvarStyleCompact {
+		fmt.Fprintln(ew.w, "}")
+		return
+	}
+	fmt.Fprintln(ew.w, "\n}")
+}
+
+// routeInfo describes the routes registered for a single pattern. DebugOnly
+// is set if all of them are only registered in builds with the debug tag.
+type routeInfo struct {
+	Pattern   string   `json:"pattern"`
+	Methods   []string `json:"methods"`
+	Names     []string `json:"names"`
+	DebugOnly bool     `json:"debugOnly"`
+}
+
+// EnableBlockProfiling sets the runtime block profile rate and makes the
+// block profile available under /debug/pprof/block. Block profiling has
+// runtime overhead, so it is off by default. A rate of zero or less turns it
+// off again.
+func (h *Handler) EnableBlockProfiling(rate int) {
+	runtime.SetBlockProfileRate(rate)
+	if rate > 0 {
+		atomic.StoreInt32(&h.blockProfiling, 1)
+	} else {
+		atomic.StoreInt32(&h.blockProfiling, 0)
+	}
+}
+
+// builtinRoutes returns the routes served directly by ServeHTTP rather than
+// through the pattern mux.
+func (h *Handler) builtinRoutes() []Route {
+	builtin := []Route{{Name: "debug-vars", Method: "GET", Pattern: "/debug/vars"}}
+	if h.Config.PprofEnabled {
+		builtin = append(builtin, Route{Name: "debug-pprof", Method: "GET", Pattern: "/debug/pprof/"})
+	}
+	return builtin
+}
+
+// serveRoutes returns the registered patterns along with the methods they accept.
+func (h *Handler) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	builtin := h.builtinRoutes()
+	byPattern := make(map[string]*routeInfo)
+	var patterns []string
+	h.mu.RLock()
+	builtin = append(builtin, h.routes...)
+	h.mu.RUnlock()
+	for _, rt := range builtin {
+		info, ok := byPattern[rt.Pattern]
+		if !ok {
+			info = &routeInfo{Pattern: rt.Pattern, DebugOnly: true}
+			byPattern[rt.Pattern] = info
+			patterns = append(patterns, rt.Pattern)
+		}
+		info.DebugOnly = info.DebugOnly && rt.DebugOnly
+		info.Methods = appendUnique(info.Methods, rt.Method)
+		info.Names = appendUnique(info.Names, rt.Name)
+	}
+	sort.Strings(patterns)
+
+	routes := make([]*routeInfo, 0, len(patterns))
+	for _, p := range patterns {
+		sort.Strings(byPattern[p].Methods)
+		routes = append(routes, byPattern[p])
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.MarshalIndent(routes, "", "  ")
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// appendUnique appends v to a if it isn't already present.
+func appendUnique(a []string, v string) []string {
+	for _, s := range a {
+		if s == v {
+			return a
+		}
+	}
+	return append(a, v)
+}
+
+// serveDebugCORS adds CORS headers to responses from the debug endpoints when
+// the request origin is allowed by the configuration. It returns true if the
+// request was a preflight request, which is answered in full.
+func (h *Handler) serveDebugCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !h.debugOriginAllowed(origin) {
+		return false
+	}
+
+	w.Header().Set(`Access-Control-Allow-Origin`, origin)
+	w.Header().Add(`Vary`, `Origin`)
+	w.Header().Set(`Access-Control-Allow-Methods`, strings.Join([]string{
+		`GET`,
+		`OPTIONS`,
+		`POST`,
+	}, ", "))
+	w.Header().Set(`Access-Control-Allow-Headers`, strings.Join([]string{
+		`Accept`,
+		`Authorization`,
+		`Content-Type`,
+	}, ", "))
+
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	h.writeHeader(w, http.StatusNoContent)
+	return true
+}
+
+// debugOriginAllowed returns true if origin may access the debug endpoints.
+func (h *Handler) debugOriginAllowed(origin string) bool {
+	for _, o := range h.Config.DebugCORSAllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// serveExpvarReset resets all statistics to zero, if the monitor supports it.
+func (h *Handler) serveExpvarReset(w http.ResponseWriter, r *http.Request, user *meta.UserInfo) {
+	if !h.authorizeDebug(w, user) {
+		return
+	}
+
+	m, ok := h.Monitor.(ResettableMonitor)
+	if !ok {
+		h.httpError(w, "monitor does not support resetting statistics", http.StatusNotImplemented)
+		return
+	}
+	m.Reset()
+	h.writeHeader(w, http.StatusNoContent)
+}
+
+// AddDebugAction registers an action that can be invoked through /debug/batch.
+// An existing action with the same name is replaced.
+func (h *Handler) AddDebugAction(name string, fn DebugAction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.debugActions[name] = fn
+}
+
+// debugAction returns the action registered under name, if any.
+func (h *Handler) debugAction(name string) DebugAction {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.debugActions[name]
+}
+
+// debugBatchRequest is a single action invocation in a /debug/batch request.
+type debugBatchRequest struct {
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// debugBatchResult is the outcome of a single action in a /debug/batch request.
+type debugBatchResult struct {
+	Action string      `json:"action"`
+	Result interface{} `json:"result,omitempty"`
+	Err    string      `json:"error,omitempty"`
+}
+
+// serveDebugBatch invokes a list of registered debug actions in order and
+// returns the result of each one. A failing action does not stop the batch.
+func (h *Handler) serveDebugBatch(w http.ResponseWriter, r *http.Request, user *meta.UserInfo) {
+	if !h.authorizeDebug(w, user) {
+		return
+	}
+
+	var reqs []debugBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		h.httpError(w, "error parsing batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]debugBatchResult, len(reqs))
+	for i, req := range reqs {
+		results[i].Action = req.Action
+
+		fn := h.debugAction(req.Action)
+		if fn == nil {
+			results[i].Err = fmt.Sprintf("unknown action: %s", req.Action)
+			continue
 		}
-		key := buf.String()
 
-		if !first {
-			fmt.Fprintln(w, ",")
+		v, err := fn(req.Params)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
 		}
-		first = false
-		fmt.Fprintf(w, "%q: ", key)
-		w.Write(bytes.TrimSpace(val))
+		results[i].Result = v
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, err := json.Marshal(results)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	fmt.Fprintln(w, "\n}")
+	w.Write(b)
+}
+
+// authorizeDebug returns true if the user may perform state-changing debug
+// operations. When authentication is enabled, only admin users may do so.
+func (h *Handler) authorizeDebug(w http.ResponseWriter, user *meta.UserInfo) bool {
+	if h.Config.AuthEnabled && (user == nil || !user.Admin) {
+		h.httpError(w, "admin privileges required", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 // httpError writes an error to the client in a standard format.
@@ -1109,6 +1866,9 @@ func (h *Handler) recovery(inner http.Handler, name string) http.Handler {
 type Response struct {
 	Results []*influxql.Result
 	Err     error
+
+	// Partial signals that the results may be incomplete.
+	Partial bool
 }
 
 // MarshalJSON encodes a Response struct into JSON.
@@ -1117,10 +1877,12 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	var o struct {
 		Results []*influxql.Result `json:"results,omitempty"`
 		Err     string             `json:"error,omitempty"`
+		Partial bool               `json:"partial,omitempty"`
 	}
 
 	// Copy fields to output struct.
 	o.Results = r.Results
+	o.Partial = r.Partial
 	if r.Err != nil {
 		o.Err = r.Err.Error()
 	}
@@ -1133,6 +1895,7 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	var o struct {
 		Results []*influxql.Result `json:"results,omitempty"`
 		Err     string             `json:"error,omitempty"`
+		Partial bool               `json:"partial,omitempty"`
 	}
 
 	err := json.Unmarshal(b, &o)
@@ -1140,12 +1903,23 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	r.Results = o.Results
+	r.Partial = o.Partial
 	if o.Err != "" {
 		r.Err = errors.New(o.Err)
 	}
 	return nil
 }
 
+// anyPartial returns true if any result, or any series within a result, is partial.
+func (r *Response) anyPartial() bool {
+	for _, result := range r.Results {
+		if result.Partial || result.Series.AnyPartial() {
+			return true
+		}
+	}
+	return false
+}
+
 // Error returns the first error from any statement.
 // Returns nil if no errors occurred on any statements.
 func (r *Response) Error() error {
@@ -1,16 +1,23 @@
 package httpd_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -18,8 +25,10 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/monitor"
 	"github.com/influxdata/influxdb/services/httpd"
 	"github.com/influxdata/influxdb/services/meta"
+	itoml "github.com/influxdata/influxdb/toml"
 )
 
 // Ensure the handler returns results from a query (including nil results).
@@ -291,6 +300,23 @@ func TestHandler_Query_Chunked(t *testing.T) {
 	}
 }
 
+// Ensure the handler reports partial results at the top level when requested.
+func TestHandler_Query_PartialSummary(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx influxql.ExecutionContext) error {
+		ctx.Results <- &influxql.Result{StatementID: 1, Series: models.Rows([]*models.Row{{Name: "series0", Partial: true}})}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar&partial_summary=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"results":[{"statement_id":1,"series":[{"name":"series0","partial":true}]}],"partial":true}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
 // Ensure the handler can accept an async query.
 func TestHandler_Query_Async(t *testing.T) {
 	done := make(chan struct{})
@@ -611,6 +637,778 @@ func TestHandler_XForwardedFor(t *testing.T) {
 	}
 }
 
+// Ensure the handler includes process statistics in the /debug/vars output.
+func TestHandler_Expvar_Process(t *testing.T) {
+	h := NewHandler(false)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var process struct {
+		Values map[string]int64 `json:"values"`
+	}
+	if err := json.Unmarshal(vars["process"], &process); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if process.Values["NumGoroutine"] <= 0 {
+		t.Fatalf("unexpected goroutine count: %d", process.Values["NumGoroutine"])
+	}
+}
+
+// Ensure the values of each statistic are emitted in sorted order.
+func TestHandler_Expvar_SortedValues(t *testing.T) {
+	h := NewHandler(false)
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		return []*monitor.Statistic{{
+			Statistic: models.Statistic{
+				Name:   "shard",
+				Tags:   map[string]string{"path": "/data/1", "id": "1"},
+				Values: map[string]interface{}{"writePointsOk": 3, "diskBytes": 1, "seriesCreate": 2},
+			},
+		}}, nil
+	}
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+		if !strings.Contains(w.Body.String(), `"values":{"diskBytes":1,"seriesCreate":2,"writePointsOk":3}`) {
+			t.Fatalf("unexpected values ordering: %s", w.Body.String())
+		}
+	}
+}
+
+// Ensure /debug/vars is served as valid JSON in each whitespace style.
+func TestHandler_Expvar_Style(t *testing.T) {
+	for _, tt := range []struct {
+		style httpd.ExpvarStyle
+		lines int
+	}{
+		{style: httpd.ExpvarStyleDefault, lines: 6},
+		{style: httpd.ExpvarStyleCompact, lines: 1},
+		{style: httpd.ExpvarStylePretty, lines: 0},
+	} {
+		h := NewHandler(false)
+		h.Config.ExpvarStyle = tt.style
+		h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+			return []*monitor.Statistic{{
+				Statistic: models.Statistic{
+					Name:   "shard",
+					Tags:   map[string]string{"path": "/data", "id": "1"},
+					Values: map[string]interface{}{"diskBytes": 1},
+				},
+			}}, nil
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+
+		var vars map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("%q: invalid JSON: %s", tt.style, err)
+		} else if _, ok := vars["shard:/data:1"]; !ok {
+			t.Fatalf("%q: missing statistic: %s", tt.style, w.Body.String())
+		}
+
+		lines := strings.Count(w.Body.String(), "\n")
+		if tt.style == httpd.ExpvarStylePretty {
+			if !strings.Contains(w.Body.String(), "\n      \"diskBytes\": 1\n") {
+				t.Fatalf("unexpected pretty output: %s", w.Body.String())
+			}
+		} else if lines != tt.lines {
+			t.Fatalf("%q: unexpected line count %d: %s", tt.style, lines, w.Body.String())
+		}
+	}
+}
+
+// Ensure the statistics a partial monitor collects are served with its errors.
+func TestHandler_Expvar_PartialErrors(t *testing.T) {
+	h := NewHandler(false)
+	h.Handler.Monitor = &PartialHandlerMonitor{
+		PartialStatisticsFn: func(tags map[string]string) ([]*monitor.Statistic, []error) {
+			stats := []*monitor.Statistic{{
+				Statistic: models.Statistic{Name: "write", Values: map[string]interface{}{"req": 1}},
+			}}
+			return stats, []error{errors.New("shard 1: disk unavailable")}
+		},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	var vars struct {
+		Write  json.RawMessage `json:"write"`
+		Errors []string        `json:"_errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	} else if vars.Write == nil {
+		t.Fatalf("missing statistics: %s", w.Body.String())
+	} else if !reflect.DeepEqual(vars.Errors, []string{"shard 1: disk unavailable"}) {
+		t.Fatalf("unexpected errors: %v", vars.Errors)
+	}
+}
+
+// Ensure the goroutine count is served along with its sampled history.
+func TestHandler_GoroutineCount(t *testing.T) {
+	type response struct {
+		Count   int `json:"count"`
+		History []struct {
+			Time  time.Time `json:"time"`
+			Count int       `json:"count"`
+		} `json:"history"`
+	}
+
+	h := NewHandler(false)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/goroutines/count", nil))
+
+	var resp response
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	} else if resp.Count <= 0 || len(resp.History) != 0 {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+
+	h.Config.GoroutineSampleInterval = itoml.Duration(time.Millisecond)
+	h.Open()
+	defer h.Close()
+
+	timeout := time.Now().Add(5 * time.Second)
+	for len(resp.History) < 2 {
+		if time.Now().After(timeout) {
+			t.Fatalf("timed out waiting for samples: %s", w.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/goroutines/count", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < len(resp.History); i++ {
+		if resp.History[i].Time.Before(resp.History[i-1].Time) {
+			t.Fatalf("samples out of order: %s", w.Body.String())
+		}
+	}
+}
+
+// Ensure large /debug/vars responses are flushed progressively.
+func TestHandler_Expvar_Flush(t *testing.T) {
+	h := NewHandler(false)
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		var stats []*monitor.Statistic
+		for i := 0; i < 150; i++ {
+			stats = append(stats, &monitor.Statistic{
+				Statistic: models.Statistic{
+					Name: "shard",
+					Tags: map[string]string{"path": "/data", "id": fmt.Sprint(i)},
+				},
+			})
+		}
+		return stats, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if !w.Flushed {
+		t.Fatal("expected response to be flushed")
+	}
+}
+
+// Ensure statistics are bundled into a zip with one file per statistic name.
+func TestHandler_ExpvarBundle(t *testing.T) {
+	h := NewHandler(false)
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		return []*monitor.Statistic{
+			{Statistic: models.Statistic{Name: "shard", Tags: map[string]string{"path": "/data/1", "id": "1"}}},
+			{Statistic: models.Statistic{Name: "shard", Tags: map[string]string{"path": "/data/2", "id": "2"}}},
+			{Statistic: models.Statistic{Name: "write"}},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars/bundle", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]map[string]json.RawMessage)
+	var manifest []struct {
+		Name     string    `json:"name"`
+		Captured time.Time `json:"captured"`
+		Size     int       `json:"size"`
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "manifest.json" {
+			if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			rc.Close()
+			continue
+		}
+		var vars map[string]json.RawMessage
+		if err := json.NewDecoder(rc).Decode(&vars); err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		rc.Close()
+		files[f.Name] = vars
+	}
+
+	if len(manifest) != 3 {
+		t.Fatalf("unexpected manifest: %v", manifest)
+	}
+	sizes := make(map[string]int)
+	for _, f := range zr.File {
+		sizes[f.Name] = int(f.UncompressedSize64)
+	}
+	for _, m := range manifest {
+		if m.Captured.IsZero() {
+			t.Fatalf("missing capture time: %v", m)
+		} else if size, ok := sizes[m.Name]; !ok || size != m.Size {
+			t.Fatalf("unexpected manifest entry: %v", m)
+		}
+	}
+
+	if len(files) != 3 {
+		t.Fatalf("unexpected files: %v", files)
+	} else if _, ok := files["shard.json"]["shard:/data/2:2"]; !ok || len(files["shard.json"]) != 2 {
+		t.Fatalf("unexpected shard statistics: %v", files["shard.json"])
+	} else if _, ok := files["process.json"]["process"]; !ok {
+		t.Fatalf("unexpected process statistics: %v", files["process.json"])
+	}
+}
+
+// Ensure clients identifying themselves receive deltas since their last scrape.
+func TestHandler_Expvar_Deltas(t *testing.T) {
+	h := NewHandler(false)
+	var n int64
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		n += 10
+		return []*monitor.Statistic{{
+			Statistic: models.Statistic{
+				Name:   "write",
+				Values: map[string]interface{}{"req": n, "state": "ok"},
+			},
+		}}, nil
+	}
+
+	scrape := func(client string) string {
+		req := MustNewRequest("GET", "/debug/vars", nil)
+		if client != "" {
+			req.Header.Set("X-Influxdb-Stats-Client", client)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var vars map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return string(vars["write"])
+	}
+
+	if v := scrape("a"); !strings.Contains(v, `"req":10`) {
+		t.Fatalf("unexpected first scrape: %s", v)
+	} else if v := scrape("a"); !strings.Contains(v, `"req":10,"state":"ok"`) {
+		t.Fatalf("unexpected delta: %s", v)
+	} else if v := scrape(""); !strings.Contains(v, `"req":30`) {
+		t.Fatalf("unexpected absolute value: %s", v)
+	} else if v := scrape("a"); !strings.Contains(v, `"req":20`) {
+		t.Fatalf("unexpected delta: %s", v)
+	}
+}
+
+// Ensure the aggregate mode sums counters and averages gauges.
+func TestHandler_Expvar_Aggregate(t *testing.T) {
+	monitor.RegisterFieldKinds("shard", map[string]monitor.FieldKind{
+		"writePointsOk": monitor.FieldCounter,
+		"diskBytes":     monitor.FieldGauge,
+	})
+
+	h := NewHandler(false)
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		return []*monitor.Statistic{{
+			Statistic: models.Statistic{
+				Name:   "shard",
+				Tags:   map[string]string{"path": "/a", "id": "1"},
+				Values: map[string]interface{}{"writePointsOk": int64(10), "diskBytes": int64(100), "fieldsCreate": int64(1), "engine": "tsm1"},
+			},
+		}, {
+			Statistic: models.Statistic{
+				Name:   "shard",
+				Tags:   map[string]string{"path": "/b", "id": "2"},
+				Values: map[string]interface{}{"writePointsOk": int64(5), "diskBytes": int64(300), "fieldsCreate": int64(2), "engine": "tsm1"},
+			},
+		}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars?aggregate=true", nil))
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	} else if _, ok := vars["shard:/a:1"]; ok {
+		t.Fatalf("unexpected per-shard statistic: %s", w.Body.String())
+	} else if got, exp := string(vars["shard"]), `{"name":"shard","tags":{},"values":{"diskBytes":200,"fieldsCreate":3,"writePointsOk":15}}`; got != exp {
+		t.Fatalf("unexpected aggregate:\n\texp=%s\n\tgot=%s", exp, got)
+	}
+}
+
+// Ensure statistics are written by the configured serializer.
+func TestHandler_Expvar_StatSerializer(t *testing.T) {
+	h := NewHandler(false)
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		return []*monitor.Statistic{{
+			Statistic: models.Statistic{Name: "write", Values: map[string]interface{}{"req": int64(2)}},
+		}}, nil
+	}
+
+	var got map[string]*monitor.Statistic
+	h.StatSerializer = &StatSerializer{
+		ContentTypeFn: func() string { return "text/csv" },
+		SerializeFn: func(w io.Writer, stats map[string]*monitor.Statistic) error {
+			got = stats
+			_, err := io.WriteString(w, "key,req\nwrite,2\n")
+			return err
+		},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("unexpected content type: %s", ct)
+	} else if body := w.Body.String(); body != "key,req\nwrite,2\n" {
+		t.Fatalf("unexpected body: %s", body)
+	} else if s := got["write"]; s == nil || s.Values["req"] != int64(2) {
+		t.Fatalf("unexpected statistics: %v", got)
+	} else if got["process"] == nil {
+		t.Fatalf("expected process statistics: %v", got)
+	}
+}
+
+// Ensure the handler resets statistics when the monitor supports it.
+func TestHandler_ExpvarReset(t *testing.T) {
+	h := NewHandler(false)
+	var reset bool
+	h.Monitor.ResetFn = func() { reset = true }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/debug/vars/reset", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if !reset {
+		t.Fatal("expected statistics to be reset")
+	}
+}
+
+// Ensure a batch of debug actions is invoked in order with per-action results.
+func TestHandler_DebugBatch(t *testing.T) {
+	h := NewHandler(false)
+	h.AddDebugAction("echo", func(params json.RawMessage) (interface{}, error) {
+		var v string
+		if err := json.Unmarshal(params, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+
+	body := `[{"action":"echo","params":"hello"},{"action":"bogus"},{"action":"gc"}]`
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/debug/batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if got, exp := strings.TrimSpace(w.Body.String()), `[{"action":"echo","result":"hello"},{"action":"bogus","error":"unknown action: bogus"},{"action":"gc"}]`; got != exp {
+		t.Fatalf("unexpected body:\n\ngot=%s\n\nexp=%s", got, exp)
+	}
+}
+
+// Ensure routes can be removed and replaced after the handler is created.
+func TestHandler_ReplaceRoutes(t *testing.T) {
+	h := NewHandler(false)
+	route := func(body string) httpd.Route {
+		return httpd.Route{
+			Name: "custom", Method: "GET", Pattern: "/custom",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			},
+		}
+	}
+
+	if err := h.AddRoutes(route("old")); err != nil {
+		t.Fatal(err)
+	}
+	h.ReplaceRoutes([]httpd.Route{route("")}, []httpd.Route{route("new")})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/custom", nil))
+	if body := w.Body.String(); body != "new" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	h.RemoveRoutes(route(""))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/custom", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	// Built-in routes must survive the rebuild.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/ping", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected ping status: %d", w.Code)
+	}
+}
+
+// Ensure ad-hoc handlers are only served to admin users when auth is enabled.
+func TestHandler_AddHandler(t *testing.T) {
+	h := NewHandler(true)
+	h.MetaClient.UsersFn = func() []meta.UserInfo {
+		return []meta.UserInfo{{Name: "admin", Admin: true}}
+	}
+	h.MetaClient.AuthenticateFn = func(u, p string) (*meta.UserInfo, error) {
+		return &meta.UserInfo{Name: u, Admin: u == "admin"}, nil
+	}
+	if err := h.AddHandler("GET", "/diag", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/diag", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status without credentials: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/diag?u=user&p=pass", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status for non-admin: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/diag?u=admin&p=pass", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status for admin: %d", w.Code)
+	} else if body := w.Body.String(); body != "ok" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/routes?u=admin&p=pass", nil))
+	if !strings.Contains(w.Body.String(), `"/diag"`) {
+		t.Fatalf("ad-hoc handler not listed: %s", w.Body.String())
+	}
+}
+
+// Ensure ad-hoc handlers can't replace routes that are already registered.
+func TestHandler_AddHandler_Conflict(t *testing.T) {
+	h := NewHandler(false)
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	if err := h.AddHandler("GET", "/diag", noop); err != nil {
+		t.Fatal(err)
+	} else if err := h.AddHandler("POST", "/diag", noop); err != nil {
+		t.Fatal(err)
+	} else if err := h.AddHandler("GET", "/diag", noop); err == nil {
+		t.Fatal("expected error for duplicate ad-hoc handler")
+	} else if err := h.AddHandler("POST", "/write", noop); err == nil {
+		t.Fatal("expected error for conflict with built-in route")
+	} else if err := h.AddHandler("GET", "/debug/vars", noop); err == nil {
+		t.Fatal("expected error for conflict with /debug/vars")
+	}
+}
+
+// Ensure routes conflicting with registered routes are rejected as a whole.
+func TestHandler_AddRoutes_Conflict(t *testing.T) {
+	h := NewHandler(false)
+	route := func(method, pattern string) httpd.Route {
+		return httpd.Route{
+			Name: "custom", Method: method, Pattern: pattern,
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(method + " " + pattern))
+			},
+		}
+	}
+
+	if err := h.AddRoutes(route("GET", "/custom")); err != nil {
+		t.Fatal(err)
+	} else if err := h.AddRoutes(route("GET", "/custom")); err == nil {
+		t.Fatal("expected error for duplicate route")
+	} else if err := h.AddRoutes(route("GET", "/ping")); err == nil {
+		t.Fatal("expected error for conflict with built-in route")
+	} else if err := h.AddRoutes(route("GET", "/debug/vars")); err == nil {
+		t.Fatal("expected error for conflict with /debug/vars")
+	} else if err := h.AddRoutes(route("GET", "/other"), route("GET", "/other")); err == nil {
+		t.Fatal("expected error for duplicate routes in one call")
+	} else if err := h.AddRoutes(route("GET", "/added"), route("GET", "/custom")); err == nil {
+		t.Fatal("expected error for conflict in the last route")
+	}
+
+	// None of the routes of a rejected call are added.
+	for _, path := range []string{"/other", "/added"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("unexpected status for %s: %d", path, w.Code)
+		}
+	}
+
+	// The first route registered is still served.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/custom", nil))
+	if body := w.Body.String(); body != "GET /custom" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+// Ensure the build endpoint reports the version and Go runtime.
+func TestHandler_DebugBuild(t *testing.T) {
+	h := NewHandler(false)
+	h.Version = "1.2.0"
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/build", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	var info struct {
+		Version   string   `json:"version"`
+		GoVersion string   `json:"goVersion"`
+		BuildTags []string `json:"buildTags"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	} else if info.Version != "1.2.0" {
+		t.Fatalf("unexpected version: %s", info.Version)
+	} else if info.GoVersion != runtime.Version() {
+		t.Fatalf("unexpected go version: %s", info.GoVersion)
+	} else if info.BuildTags == nil {
+		t.Fatal("expected build tags to be present")
+	}
+}
+
+// Ensure the block profile is only served while block profiling is enabled.
+func TestHandler_BlockProfiling(t *testing.T) {
+	h := NewHandler(false)
+	h.Config.PprofEnabled = true
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/pprof/block", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	h.EnableBlockProfiling(1)
+	defer h.EnableBlockProfiling(0)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/pprof/block?debug=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+// Ensure the debug endpoints only emit CORS headers for allowed origins.
+func TestHandler_DebugCORS(t *testing.T) {
+	h := NewHandler(false)
+	h.Config.DebugCORSAllowedOrigins = []string{"http://dashboard"}
+
+	req := MustNewRequest("OPTIONS", "/debug/vars", nil)
+	req.Header.Set("Origin", "http://dashboard")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if v := w.Header().Get("Access-Control-Allow-Origin"); v != "http://dashboard" {
+		t.Fatalf("unexpected allowed origin: %s", v)
+	}
+
+	req = MustNewRequest("GET", "/debug/vars", nil)
+	req.Header.Set("Origin", "http://elsewhere")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "" {
+		t.Fatalf("unexpected allowed origin: %s", v)
+	}
+
+	// Debug endpoints served through the pattern mux follow the same rules.
+	for origin, exp := range map[string]string{
+		"http://dashboard": "http://dashboard",
+		"http://elsewhere": "",
+	} {
+		req = MustNewRequest("GET", "/debug/routes", nil)
+		req.Header.Set("Origin", origin)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		} else if v := w.Header().Get("Access-Control-Allow-Origin"); v != exp {
+			t.Fatalf("unexpected allowed origin for %s: %s", origin, v)
+		}
+	}
+
+	// Other endpoints keep the permissive CORS headers.
+	req = MustNewRequest("GET", "/ping", nil)
+	req.Header.Set("Origin", "http://elsewhere")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "http://elsewhere" {
+		t.Fatalf("unexpected allowed origin: %s", v)
+	}
+}
+
+// Ensure statistics can be dumped to a file.
+func TestHandler_DumpVarsTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewHandler(false)
+	path := filepath.Join(dir, "vars.json")
+	if err := h.DumpVarsTo(path); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &vars); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if _, ok := vars["process"]; !ok {
+		t.Fatalf("missing process statistics: %s", buf)
+	}
+}
+
+// Ensure the handler lists its registered routes.
+func TestHandler_Routes(t *testing.T) {
+	h := NewHandler(false)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/routes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	var routes []struct {
+		Pattern string   `json:"pattern"`
+		Methods []string `json:"methods"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, r := range routes {
+		if r.Pattern == "/query" {
+			if !reflect.DeepEqual(r.Methods, []string{"GET", "OPTIONS", "POST"}) {
+				t.Fatalf("unexpected methods: %v", r.Methods)
+			}
+			return
+		}
+	}
+	t.Fatalf("/query route not found: %s", w.Body.String())
+}
+
+// Ensure the handler reports which routes are only registered in debug builds.
+func TestHandler_Routes_DebugOnly(t *testing.T) {
+	h := NewHandler(false)
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	if err := h.AddRoutes(
+		httpd.Route{Name: "debug-only", Method: "GET", Pattern: "/debug/only", HandlerFunc: noop, DebugOnly: true},
+		httpd.Route{Name: "debug-mixed", Method: "GET", Pattern: "/debug/mixed", HandlerFunc: noop, DebugOnly: true},
+		httpd.Route{Name: "debug-mixed", Method: "POST", Pattern: "/debug/mixed", HandlerFunc: noop},
+	); err != nil {
+		t.Fatal(err)
+	} else if err := h.AddDebugHandler("GET", "/debug/handler", http.HandlerFunc(noop)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("GET", "/debug/routes", nil))
+	var routes []struct {
+		Pattern   string `json:"pattern"`
+		DebugOnly bool   `json:"debugOnly"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	debugOnly := make(map[string]bool)
+	for _, r := range routes {
+		debugOnly[r.Pattern] = r.DebugOnly
+	}
+	if exp := map[string]bool{
+		"/debug/only":    true,
+		"/debug/handler": true,
+		"/debug/mixed":   false,
+		"/query":         false,
+		"/debug/vars":    false,
+	}; !reflect.DeepEqual(filterKeys(debugOnly, exp), exp) {
+		t.Fatalf("unexpected debug-only routes: %v", debugOnly)
+	}
+}
+
+// filterKeys returns the entries of m whose keys are in keys.
+func filterKeys(m, keys map[string]bool) map[string]bool {
+	other := make(map[string]bool, len(keys))
+	for k := range keys {
+		if v, ok := m[k]; ok {
+			other[k] = v
+		}
+	}
+	return other
+}
+
+// Ensure statistics are cached between scrapes when a cache TTL is set.
+func TestHandler_Expvar_Cache(t *testing.T) {
+	h := NewHandler(false)
+	h.Config.StatsCacheTTL = itoml.Duration(time.Hour)
+	var n int
+	h.Monitor.StatisticsFn = func(tags map[string]string) ([]*monitor.Statistic, error) {
+		n++
+		return []*monitor.Statistic{{Statistic: models.NewStatistic("test")}}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/vars", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		} else if !strings.Contains(w.Body.String(), `"test":`) {
+			t.Fatalf("missing statistic: %s", w.Body.String())
+		}
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of monitor calls: %d", n)
+	}
+}
+
 type invalidJSON struct{}
 
 func (*invalidJSON) MarshalJSON() ([]byte, error) { return nil, errors.New("marker") }
@@ -621,6 +1419,7 @@ type Handler struct {
 	MetaClient        HandlerMetaStore
 	StatementExecutor HandlerStatementExecutor
 	QueryAuthorizer   HandlerQueryAuthorizer
+	Monitor           HandlerMonitor
 }
 
 // NewHandler returns a new instance of Handler.
@@ -636,6 +1435,7 @@ func NewHandler(requireAuthentication bool) *Handler {
 	h.Handler.QueryExecutor = influxql.NewQueryExecutor()
 	h.Handler.QueryExecutor.StatementExecutor = &h.StatementExecutor
 	h.Handler.QueryAuthorizer = &h.QueryAuthorizer
+	h.Handler.Monitor = &h.Monitor
 	h.Handler.Version = "0.0.0"
 	return h
 }
@@ -691,6 +1491,54 @@ func (a *HandlerQueryAuthorizer) AuthorizeQuery(u *meta.UserInfo, query *influxq
 	return a.AuthorizeQueryFn(u, query, database)
 }
 
+// HandlerMonitor is a mock implementation of Handler.Monitor.
+type HandlerMonitor struct {
+	StatisticsFn func(tags map[string]string) ([]*monitor.Statistic, error)
+	ResetFn      func()
+}
+
+func (m *HandlerMonitor) Statistics(tags map[string]string) ([]*monitor.Statistic, error) {
+	if m.StatisticsFn == nil {
+		return nil, nil
+	}
+	return m.StatisticsFn(tags)
+}
+
+func (m *HandlerMonitor) Reset() {
+	m.ResetFn()
+}
+
+// PartialHandlerMonitor is a mock implementation of httpd.PartialMonitor.
+type PartialHandlerMonitor struct {
+	PartialStatisticsFn func(tags map[string]string) ([]*monitor.Statistic, []error)
+}
+
+func (m *PartialHandlerMonitor) Statistics(tags map[string]string) ([]*monitor.Statistic, error) {
+	stats, errs := m.PartialStatisticsFn(tags)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return stats, nil
+}
+
+func (m *PartialHandlerMonitor) PartialStatistics(tags map[string]string) ([]*monitor.Statistic, []error) {
+	return m.PartialStatisticsFn(tags)
+}
+
+// StatSerializer is a mock implementation of httpd.StatSerializer.
+type StatSerializer struct {
+	ContentTypeFn func() string
+	SerializeFn   func(w io.Writer, stats map[string]*monitor.Statistic) error
+}
+
+func (s *StatSerializer) ContentType() string {
+	return s.ContentTypeFn()
+}
+
+func (s *StatSerializer) Serialize(w io.Writer, stats map[string]*monitor.Statistic) error {
+	return s.SerializeFn(w, stats)
+}
+
 // MustNewRequest returns a new HTTP request. Panic on error.
 func MustNewRequest(method, urlStr string, body io.Reader) *http.Request {
 	r, err := http.NewRequest(method, urlStr, body)
@@ -1,10 +1,81 @@
 package httpd
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
+// ServeUnix serves h on a unix socket at path, which only the owner of the
+// process can connect to. An existing socket at path is replaced, but any
+// other kind of file there is an error. Closing the returned Closer stops
+// accepting connections and removes the socket.
+func ServeUnix(path string, h http.Handler) (io.Closer, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Create the socket in a directory only the owner can enter, so that it
+	// can't be connected to before its permissions are restricted, then move
+	// it into place.
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	go http.Serve(ln, h)
+	return &unixServer{ln: ln, path: path, fi: fi}, nil
+}
+
+// unixServer stops serving a unix socket when closed.
+type unixServer struct {
+	ln   net.Listener
+	path string
+
+	// fi identifies the socket created at path.
+	fi os.FileInfo
+}
+
+// Close closes the listener and removes the socket, unless another file,
+// such as the socket of a newer server, has replaced it.
+func (s *unixServer) Close() error {
+	err := s.ln.Close()
+	if fi, lerr := os.Lstat(s.path); lerr != nil || !os.SameFile(fi, s.fi) {
+		return err
+	}
+	if rerr := os.Remove(s.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
+
 // LimitListener returns a Listener that accepts at most n simultaneous
 // connections from the provided Listener and will drop extra connections.
 func LimitListener(l net.Listener, n int) net.Listener {
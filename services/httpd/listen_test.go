@@ -2,7 +2,12 @@ package httpd_test
 
 import (
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -94,3 +99,113 @@ func BenchmarkLimitListener(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+// Ensure a handler can be served on a unix socket only its owner can access.
+func TestServeUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "httpd-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "debug.sock")
+
+	c, err := httpd.ServeUnix(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("unexpected socket permissions: %o", perm)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://unix/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(body) != "ok" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed: %v", err)
+	}
+
+	// Only the socket is created in the directory.
+	if fis, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 0 {
+		t.Fatalf("unexpected files left behind: %d", len(fis))
+	}
+}
+
+// Ensure ServeUnix replaces an existing socket but refuses to remove other files.
+func TestServeUnix_Existing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "httpd-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := http.NotFoundHandler()
+
+	// An existing socket is replaced.
+	path := filepath.Join(dir, "debug.sock")
+	old, err := httpd.ServeUnix(path, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := httpd.ServeUnix(path, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the replaced server leaves the new socket in place.
+	old.Close()
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Fatalf("new socket removed: %s", err)
+	} else {
+		conn.Close()
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed: %v", err)
+	}
+
+	// Regular files and symlinks are left alone.
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{file, link} {
+		if _, err := httpd.ServeUnix(p, h); err == nil {
+			t.Fatalf("expected error for %s", p)
+		} else if _, err := os.Lstat(p); err != nil {
+			t.Fatalf("%s removed: %s", p, err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package httpd
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/monitor"
+)
+
+// Monitor is the interface the handler uses to retrieve statistics.
+type Monitor interface {
+	Statistics(tags map[string]string) ([]*monitor.Statistic, error)
+}
+
+// ResettableMonitor is a monitor whose statistics can be reset to zero.
+type ResettableMonitor interface {
+	Monitor
+	Reset()
+}
+
+// PartialMonitor is a monitor that can return the statistics it was able to
+// collect along with errors describing those it wasn't, so that a failing
+// subsystem doesn't prevent the other statistics from being served.
+type PartialMonitor interface {
+	Monitor
+	PartialStatistics(tags map[string]string) ([]*monitor.Statistic, []error)
+}
+
+// monitorStatistics returns the statistics of m. If m is a PartialMonitor,
+// the errors of the statistics it couldn't collect are returned as well.
+func monitorStatistics(m Monitor) ([]*monitor.Statistic, []error, error) {
+	if pm, ok := m.(PartialMonitor); ok {
+		stats, errs := pm.PartialStatistics(nil)
+		return stats, errs, nil
+	}
+	stats, err := m.Statistics(nil)
+	return stats, nil, err
+}
+
+// multiMonitor combines the statistics of several monitors into one set.
+type multiMonitor []Monitor
+
+// Statistics returns the statistics of every monitor, in order. An error from
+// any monitor is returned immediately.
+func (a multiMonitor) Statistics(tags map[string]string) ([]*monitor.Statistic, error) {
+	var statistics []*monitor.Statistic
+	for _, m := range a {
+		if m == nil {
+			continue
+		}
+		stats, err := m.Statistics(tags)
+		if err != nil {
+			return nil, err
+		}
+		statistics = append(statistics, stats...)
+	}
+	return statistics, nil
+}
+
+// staticMonitor is a monitor returning a fixed set of statistics.
+type staticMonitor []*monitor.Statistic
+
+// Statistics returns the statistics.
+func (a staticMonitor) Statistics(tags map[string]string) ([]*monitor.Statistic, error) {
+	return a, nil
+}
+
+func init() {
+	monitor.RegisterFieldKinds("process", map[string]monitor.FieldKind{
+		"NumGoroutine":  monitor.FieldGauge,
+		"HeapAlloc":     monitor.FieldGauge,
+		"NumGC":         monitor.FieldCounter,
+		"LastGC":        monitor.FieldGauge,
+		"LastGCPauseNs": monitor.FieldGauge,
+	})
+}
+
+// runtimeMonitor reports basic process health: the goroutine count, the heap
+// size and the most recent GC pause. Values are read fresh on every call.
+type runtimeMonitor struct{}
+
+// Statistics returns a single "process" statistic.
+func (runtimeMonitor) Statistics(tags map[string]string) ([]*monitor.Statistic, error) {
+	var rt runtime.MemStats
+	runtime.ReadMemStats(&rt)
+
+	statistic := &monitor.Statistic{
+		Statistic: models.NewStatistic("process"),
+	}
+	for k, v := range tags {
+		statistic.Tags[k] = v
+	}
+
+	statistic.Values = map[string]interface{}{
+		"NumGoroutine":  int64(runtime.NumGoroutine()),
+		"HeapAlloc":     int64(rt.HeapAlloc),
+		"NumGC":         int64(rt.NumGC),
+		"LastGC":        int64(rt.LastGC),
+		"LastGCPauseNs": int64(rt.PauseNs[(rt.NumGC+255)%256]),
+	}
+	return []*monitor.Statistic{statistic}, nil
+}
+
+// statsCache caches the statistics returned by a monitor for a period of
+// time, so that frequent scrapes don't recompute them on every request.
+type statsCache struct {
+	mu         sync.Mutex
+	stats      []*monitor.Statistic
+	errs       []error
+	fetched    time.Time
+	refreshing bool
+}
+
+// get returns the cached statistics if they are younger than ttl, along with
+// the errors of any statistics that couldn't be collected. Stale statistics
+// are returned while a refresh runs in the background. If nothing is cached,
+// the statistics are retrieved synchronously.
+func (c *statsCache) get(m Monitor, ttl time.Duration) ([]*monitor.Statistic, []error, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats == nil {
+		stats, errs, err := monitorStatistics(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.stats, c.errs, c.fetched = stats, errs, time.Now()
+		return stats, errs, nil
+	}
+
+	if time.Since(c.fetched) >= ttl && !c.refreshing {
+		c.refreshing = true
+		go c.refresh(m)
+	}
+	return c.stats, c.errs, nil
+}
+
+// refresh retrieves new statistics from the monitor. On error the cache is
+// cleared so that the next request retrieves the statistics itself.
+func (c *statsCache) refresh(m Monitor) {
+	stats, errs, err := monitorStatistics(m)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		c.stats, c.errs = nil, nil
+		return
+	}
+	c.stats, c.errs, c.fetched = stats, errs, time.Now()
+}
+
+// statsDeltaExpiry is how long the snapshot of a client that has stopped
+// scraping is retained.
+const statsDeltaExpiry = 10 * time.Minute
+
+// maxStatsDeltaClients is the maximum number of clients whose snapshots are
+// retained. The client identifier is supplied by the client, so without a
+// limit rotating it would grow memory without bound.
+const maxStatsDeltaClients = 64
+
+// statsDeltas tracks the last statistics returned to each client so that the
+// difference since a client's previous scrape can be returned.
+type statsDeltas struct {
+	mu      sync.Mutex
+	clients map[string]*statsSnapshot
+}
+
+// statsSnapshot holds the values returned to a client, by statistic key.
+type statsSnapshot struct {
+	values map[string]map[string]interface{}
+	seen   time.Time
+}
+
+// deltas returns copies of stats whose numeric values are the difference
+// since the client's previous call. On a client's first call, the values are
+// returned unchanged. Non-numeric values are always returned unchanged.
+//
+// At most maxStatsDeltaClients snapshots are retained; when a new client
+// would exceed the limit, the client seen least recently is forgotten.
+func (d *statsDeltas) deltas(client string, stats []*monitor.Statistic, now time.Time) []*monitor.Statistic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev := d.clients[client]
+	if prev != nil && now.Sub(prev.seen) > statsDeltaExpiry {
+		prev = nil
+	}
+	if _, ok := d.clients[client]; !ok && len(d.clients) >= maxStatsDeltaClients {
+		d.evict(now)
+	}
+	next := &statsSnapshot{values: make(map[string]map[string]interface{}, len(stats)), seen: now}
+
+	deltas := make([]*monitor.Statistic, len(stats))
+	for i, s := range stats {
+		key := expvarKey(s)
+		next.values[key] = s.Values
+
+		other := &monitor.Statistic{Statistic: models.Statistic{
+			Name:   s.Name,
+			Tags:   s.Tags,
+			Values: make(map[string]interface{}, len(s.Values)),
+		}}
+		for k, v := range s.Values {
+			other.Values[k] = v
+			if prev != nil {
+				if pv, ok := prev.values[key][k]; ok {
+					if dv, ok := valueDelta(v, pv); ok {
+						other.Values[k] = dv
+					}
+				}
+			}
+		}
+		deltas[i] = other
+	}
+
+	if d.clients == nil {
+		d.clients = make(map[string]*statsSnapshot)
+	}
+	d.clients[client] = next
+	return deltas
+}
+
+// evict forgets the clients which have stopped scraping or, if there are
+// none, the client seen least recently. The number of clients is bounded by
+// maxStatsDeltaClients, so the scan is too.
+func (d *statsDeltas) evict(now time.Time) {
+	var oldest string
+	var oldestSeen time.Time
+	var expired bool
+	for id, snap := range d.clients {
+		if now.Sub(snap.seen) > statsDeltaExpiry {
+			delete(d.clients, id)
+			expired = true
+		} else if oldest == "" || snap.seen.Before(oldestSeen) {
+			oldest, oldestSeen = id, snap.seen
+		}
+	}
+	if !expired && oldest != "" {
+		delete(d.clients, oldest)
+	}
+}
+
+// valueDelta returns v-prev if both are numbers of the same kind.
+func valueDelta(v, prev interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case int64:
+		if p, ok := prev.(int64); ok {
+			return v - p, true
+		}
+	case int:
+		if p, ok := prev.(int); ok {
+			return int64(v - p), true
+		}
+	case uint64:
+		if p, ok := prev.(uint64); ok {
+			return int64(v - p), true
+		}
+	case float64:
+		if p, ok := prev.(float64); ok {
+			return v - p, true
+		}
+	}
+	return nil, false
+}
+
+// aggregateStatistics rolls up the statistics sharing a name into a single
+// statistic without tags. Gauge fields are averaged over the statistics that
+// have them; counters and fields of unknown kind are summed. Non-numeric
+// values are dropped. The statistics are returned in the order their names
+// first appear.
+func aggregateStatistics(stats []*monitor.Statistic) []*monitor.Statistic {
+	type field struct {
+		kind    monitor.FieldKind
+		isFloat bool
+		i       int64
+		f       float64
+		n       int
+	}
+
+	var names []string
+	groups := make(map[string]map[string]*field)
+	for _, s := range stats {
+		fields, ok := groups[s.Name]
+		if !ok {
+			fields = make(map[string]*field)
+			groups[s.Name] = fields
+			names = append(names, s.Name)
+		}
+
+		for k, v := range s.Values {
+			var i int64
+			var f float64
+			var isFloat bool
+			switch v := v.(type) {
+			case int64:
+				i = v
+			case int:
+				i = int64(v)
+			case uint64:
+				i = int64(v)
+			case float64:
+				f, isFloat = v, true
+			default:
+				continue
+			}
+
+			fld := fields[k]
+			if fld == nil {
+				fld = &field{kind: s.FieldKind(k)}
+				fields[k] = fld
+			}
+			if isFloat && !fld.isFloat {
+				fld.isFloat, fld.f = true, float64(fld.i)
+			}
+			if fld.isFloat {
+				fld.f += f + float64(i)
+			} else {
+				fld.i += i
+			}
+			fld.n++
+		}
+	}
+
+	aggregates := make([]*monitor.Statistic, len(names))
+	for i, name := range names {
+		fields := groups[name]
+		s := &monitor.Statistic{Statistic: models.NewStatistic(name)}
+		for k, fld := range fields {
+			switch {
+			case fld.kind == monitor.FieldGauge && fld.isFloat:
+				s.Values[k] = fld.f / float64(fld.n)
+			case fld.kind == monitor.FieldGauge:
+				s.Values[k] = float64(fld.i) / float64(fld.n)
+			case fld.isFloat:
+				s.Values[k] = fld.f
+			default:
+				s.Values[k] = fld.i
+			}
+		}
+		aggregates[i] = s
+	}
+	return aggregates
+}
@@ -0,0 +1,44 @@
+package httpd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/monitor"
+)
+
+// Ensure the number of clients tracked for deltas is bounded, forgetting the
+// client seen least recently.
+func TestStatsDeltas_MaxClients(t *testing.T) {
+	stats := func(n int64) []*monitor.Statistic {
+		return []*monitor.Statistic{{
+			Statistic: models.Statistic{Name: "write", Values: map[string]interface{}{"req": n}},
+		}}
+	}
+
+	var d statsDeltas
+	now := time.Unix(0, 0)
+	for i := 0; i < maxStatsDeltaClients+10; i++ {
+		now = now.Add(time.Second)
+		d.deltas(fmt.Sprintf("client-%d", i), stats(10), now)
+	}
+	if n := len(d.clients); n != maxStatsDeltaClients {
+		t.Fatalf("unexpected number of clients: %d", n)
+	} else if _, ok := d.clients["client-0"]; ok {
+		t.Fatal("expected least recently seen client to be forgotten")
+	}
+
+	// A retained client still receives deltas.
+	last := fmt.Sprintf("client-%d", maxStatsDeltaClients+9)
+	if v := d.deltas(last, stats(15), now)[0].Values["req"]; v != int64(5) {
+		t.Fatalf("unexpected delta: %v", v)
+	}
+
+	// An expired snapshot isn't used.
+	now = now.Add(statsDeltaExpiry + time.Second)
+	if v := d.deltas(last, stats(20), now)[0].Values["req"]; v != int64(20) {
+		t.Fatalf("unexpected value after expiry: %v", v)
+	}
+}
@@ -151,6 +151,8 @@ func (s *Service) Open() error {
 		time.Sleep(10 * time.Millisecond)
 	}
 
+	s.Handler.Open()
+
 	// Begin listening for requests in a separate goroutine.
 	go s.serveTCP()
 	return nil
@@ -158,6 +160,7 @@ func (s *Service) Open() error {
 
 // Close closes the underlying listener.
 func (s *Service) Close() error {
+	s.Handler.Close()
 	if s.ln != nil {
 		if err := s.ln.Close(); err != nil {
 			return err
@@ -768,10 +768,19 @@ func (c *Client) DeleteShardGroup(database, policy string, id uint64) error {
 // for the corresponding time range arrives. Shard creation involves Raft consensus, and precreation
 // avoids taking the hit at write-time.
 func (c *Client) PrecreateShardGroups(from, to time.Time) error {
+	_, err := c.PrecreateShardGroupsAhead(from, to, 1)
+	return err
+}
+
+// PrecreateShardGroupsAhead is like PrecreateShardGroups but creates up to n successive
+// shard groups after each group that needs a successor, so writes crossing several shard
+// group boundaries don't have to wait for a shard group to be created. It returns the IDs
+// of the shard groups created.
+func (c *Client) PrecreateShardGroupsAhead(from, to time.Time, n int) ([]uint64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	data := c.cacheData.Clone()
-	var changed bool
+	var created []uint64
 
 	for _, di := range data.Databases {
 		for _, rp := range di.RetentionPolicies {
@@ -785,31 +794,36 @@ func (c *Client) PrecreateShardGroups(from, to time.Time) error {
 				// This last check is important, so the system doesn't create shards groups wholly
 				// in the past.
 
-				// Create successive shard group.
-				nextShardGroupTime := g.EndTime.Add(1 * time.Nanosecond)
-				// if it already exists, continue
-				if sg, _ := data.ShardGroupByTimestamp(di.Name, rp.Name, nextShardGroupTime); sg != nil {
-					c.logger.Info(fmt.Sprintf("shard group %d exists for database %s, retention policy %s", sg.ID, di.Name, rp.Name))
-					continue
-				}
-				newGroup, err := createShardGroup(data, di.Name, rp.Name, nextShardGroupTime)
-				if err != nil {
-					c.logger.Info(fmt.Sprintf("failed to precreate successive shard group for group %d: %s", g.ID, err.Error()))
-					continue
+				// Create successive shard groups.
+				prev := &g
+				for i := 0; i < n; i++ {
+					nextShardGroupTime := prev.EndTime.Add(1 * time.Nanosecond)
+					// if it already exists, move on to its successor
+					if sg, _ := data.ShardGroupByTimestamp(di.Name, rp.Name, nextShardGroupTime); sg != nil {
+						c.logger.Info(fmt.Sprintf("shard group %d exists for database %s, retention policy %s", sg.ID, di.Name, rp.Name))
+						prev = sg
+						continue
+					}
+					newGroup, err := createShardGroup(data, di.Name, rp.Name, nextShardGroupTime)
+					if err != nil {
+						c.logger.Info(fmt.Sprintf("failed to precreate successive shard group for group %d: %s", prev.ID, err.Error()))
+						break
+					}
+					created = append(created, newGroup.ID)
+					c.logger.Info(fmt.Sprintf("new shard group %d successfully precreated for database %s, retention policy %s", newGroup.ID, di.Name, rp.Name))
+					prev = newGroup
 				}
-				changed = true
-				c.logger.Info(fmt.Sprintf("new shard group %d successfully precreated for database %s, retention policy %s", newGroup.ID, di.Name, rp.Name))
 			}
 		}
 	}
 
-	if changed {
+	if len(created) > 0 {
 		if err := c.commit(data); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return created, nil
 }
 
 // ShardOwner returns the owning shard group info for a specific shard.
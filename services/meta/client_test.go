@@ -906,6 +906,53 @@ func TestMetaClient_Shards(t *testing.T) {
 	}
 }
 
+// Ensure several successive shard groups can be precreated at once.
+func TestMetaClient_PrecreateShardGroupsAhead(t *testing.T) {
+	t.Parallel()
+
+	d, c := newClient()
+	defer os.RemoveAll(d)
+	defer c.Close()
+
+	if _, err := c.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+
+	tmin := time.Now()
+	sg, err := c.CreateShardGroup("db0", "autogen", tmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dur := sg.EndTime.Sub(sg.StartTime)
+	tmax := tmin.Add(dur + time.Nanosecond)
+	ids, err := c.PrecreateShardGroupsAhead(tmin, tmax, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 3 {
+		t.Fatalf("unexpected shard groups created: %v", ids)
+	}
+
+	groups, err := c.ShardGroupsByTimeRange("db0", "autogen", tmin, tmin.Add(4*dur))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(groups) != 4 {
+		t.Fatalf("wrong number of shard groups: %d", len(groups))
+	}
+	for i, id := range ids {
+		if groups[i+1].ID != id {
+			t.Fatalf("unexpected shard group %d, exp %d", groups[i+1].ID, id)
+		}
+	}
+
+	// The last group doesn't end before the cutoff, so nothing more is created.
+	if ids, err := c.PrecreateShardGroupsAhead(tmin, tmax, 3); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 0 {
+		t.Fatalf("unexpected shard groups created again: %v", ids)
+	}
+}
+
 // Tests that calling CreateShardGroup for the same time range doesn't increment the data.Index
 func TestMetaClient_CreateShardGroupIdempotent(t *testing.T) {
 	t.Parallel()
@@ -13,6 +13,10 @@ const (
 	// DefaultAdvancePeriod is the default period ahead of the endtime of a shard group
 	// that its successor group is created.
 	DefaultAdvancePeriod = 30 * time.Minute
+
+	// DefaultPrecreateAhead is the default number of successive shard groups
+	// precreated at a time.
+	DefaultPrecreateAhead = 1
 )
 
 // Config represents the configuration for shard precreation.
@@ -20,13 +24,18 @@ type Config struct {
 	Enabled       bool          `toml:"enabled"`
 	CheckInterval toml.Duration `toml:"check-interval"`
 	AdvancePeriod toml.Duration `toml:"advance-period"`
+
+	// PrecreateAhead is the number of successive shard groups created when a
+	// shard group is about to end.
+	PrecreateAhead int `toml:"precreate-ahead"`
 }
 
 // NewConfig returns a new Config with defaults.
 func NewConfig() Config {
 	return Config{
-		Enabled:       true,
-		CheckInterval: toml.Duration(DefaultCheckInterval),
-		AdvancePeriod: toml.Duration(DefaultAdvancePeriod),
+		Enabled:        true,
+		CheckInterval:  toml.Duration(DefaultCheckInterval),
+		AdvancePeriod:  toml.Duration(DefaultAdvancePeriod),
+		PrecreateAhead: DefaultPrecreateAhead,
 	}
 }
@@ -15,6 +15,7 @@ func TestConfig_Parse(t *testing.T) {
 enabled = true
 check-interval = "2m"
 advance-period = "10m"
+precreate-ahead = 3
 `, &c); err != nil {
 
 		t.Fatal(err)
@@ -27,5 +28,7 @@ advance-period = "10m"
 		t.Fatalf("unexpected check interval: %s", c.CheckInterval)
 	} else if time.Duration(c.AdvancePeriod) != 10*time.Minute {
 		t.Fatalf("unexpected advance period: %s", c.AdvancePeriod)
+	} else if c.PrecreateAhead != 3 {
+		t.Fatalf("unexpected precreate ahead: %d", c.PrecreateAhead)
 	}
 }
@@ -11,8 +11,9 @@ import (
 
 // Service manages the shard precreation service.
 type Service struct {
-	checkInterval time.Duration
-	advancePeriod time.Duration
+	checkInterval  time.Duration
+	advancePeriod  time.Duration
+	precreateAhead int
 
 	Logger zap.Logger
 
@@ -20,16 +21,20 @@ type Service struct {
 	wg   sync.WaitGroup
 
 	MetaClient interface {
-		PrecreateShardGroups(now, cutoff time.Time) error
+		PrecreateShardGroupsAhead(now, cutoff time.Time, n int) ([]uint64, error)
 	}
 }
 
 // NewService returns an instance of the precreation service.
 func NewService(c Config) (*Service, error) {
 	s := Service{
-		checkInterval: time.Duration(c.CheckInterval),
-		advancePeriod: time.Duration(c.AdvancePeriod),
-		Logger:        zap.New(zap.NullEncoder()),
+		checkInterval:  time.Duration(c.CheckInterval),
+		advancePeriod:  time.Duration(c.AdvancePeriod),
+		precreateAhead: c.PrecreateAhead,
+		Logger:         zap.New(zap.NullEncoder()),
+	}
+	if s.precreateAhead < 1 {
+		s.precreateAhead = 1
 	}
 
 	return &s, nil
@@ -76,7 +81,7 @@ func (s *Service) runPrecreation() {
 	for {
 		select {
 		case <-time.After(s.checkInterval):
-			if err := s.precreate(time.Now().UTC()); err != nil {
+			if _, err := s.precreate(time.Now().UTC()); err != nil {
 				s.Logger.Info(fmt.Sprintf("failed to precreate shards: %s", err.Error()))
 			}
 		case <-s.done:
@@ -86,11 +91,21 @@ func (s *Service) runPrecreation() {
 	}
 }
 
+// Precreate runs precreation immediately rather than waiting for the next
+// check, and returns the IDs of the shard groups it created.
+func (s *Service) Precreate() ([]uint64, error) {
+	return s.precreate(time.Now().UTC())
+}
+
 // precreate performs actual resource precreation.
-func (s *Service) precreate(now time.Time) error {
+func (s *Service) precreate(now time.Time) ([]uint64, error) {
 	cutoff := now.Add(s.advancePeriod).UTC()
-	if err := s.MetaClient.PrecreateShardGroups(now, cutoff); err != nil {
-		return err
+	ids, err := s.MetaClient.PrecreateShardGroupsAhead(now, cutoff, s.precreateAhead)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if len(ids) > 0 {
+		s.Logger.Info(fmt.Sprintf("precreated %d shard groups", len(ids)))
+	}
+	return ids, nil
 }
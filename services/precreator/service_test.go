@@ -1,6 +1,7 @@
 package precreator
 
 import (
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -18,27 +19,32 @@ func Test_ShardPrecreation(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	ms := metaClient{
-		PrecreateShardGroupsFn: func(v, u time.Time) error {
+		PrecreateShardGroupsFn: func(v, u time.Time, n int) ([]uint64, error) {
 			wg.Done()
 			if u != now.Add(advancePeriod) {
 				t.Fatalf("precreation called with wrong time, got %s, exp %s", u, now)
+			} else if n != 3 {
+				t.Fatalf("precreation called with wrong number of shard groups, got %d, exp 3", n)
 			}
-			return nil
+			return []uint64{4, 5, 6}, nil
 		},
 	}
 
 	srv, err := NewService(Config{
-		CheckInterval: toml.Duration(time.Minute),
-		AdvancePeriod: toml.Duration(advancePeriod),
+		CheckInterval:  toml.Duration(time.Minute),
+		AdvancePeriod:  toml.Duration(advancePeriod),
+		PrecreateAhead: 3,
 	})
 	if err != nil {
 		t.Fatalf("failed to create shard precreation service: %s", err.Error())
 	}
 	srv.MetaClient = ms
 
-	err = srv.precreate(now)
+	ids, err := srv.precreate(now)
 	if err != nil {
 		t.Fatalf("failed to precreate shards: %s", err.Error())
+	} else if !reflect.DeepEqual(ids, []uint64{4, 5, 6}) {
+		t.Fatalf("unexpected shard groups created: %v", ids)
 	}
 
 	wg.Wait() // Ensure metaClient test function is called.
@@ -47,9 +53,9 @@ func Test_ShardPrecreation(t *testing.T) {
 
 // PointsWriter represents a mock impl of PointsWriter.
 type metaClient struct {
-	PrecreateShardGroupsFn func(now, cutoff time.Time) error
+	PrecreateShardGroupsFn func(now, cutoff time.Time, n int) ([]uint64, error)
 }
 
-func (m metaClient) PrecreateShardGroups(now, cutoff time.Time) error {
-	return m.PrecreateShardGroupsFn(now, cutoff)
+func (m metaClient) PrecreateShardGroupsAhead(now, cutoff time.Time, n int) ([]uint64, error) {
+	return m.PrecreateShardGroupsFn(now, cutoff, n)
 }
@@ -0,0 +1,62 @@
+package retention
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker for meta client calls. It trips after a number
+// of consecutive failures and stays open for a cooldown period, during which
+// retention passes are skipped. A successful call resets it.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// newBreaker returns a breaker which trips after threshold consecutive
+// failures. A threshold of zero returns a breaker which never trips.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns false while the breaker is open.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	} else if now.Before(b.openUntil) {
+		return false
+	}
+
+	// The cooldown has elapsed; close the breaker and try again.
+	b.openUntil = time.Time{}
+	b.failures = 0
+	return true
+}
+
+// success resets the consecutive failure count.
+func (b *breaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+// failure records a failed call and returns true if it tripped the breaker.
+func (b *breaker) failure(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || !b.openUntil.IsZero() {
+		return false
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
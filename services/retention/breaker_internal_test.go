@@ -0,0 +1,36 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure the breaker trips after consecutive failures and recovers after the cooldown.
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute)
+
+	if b.failure(now) {
+		t.Fatal("unexpected trip after one failure")
+	}
+	b.success()
+	if b.failure(now) {
+		t.Fatal("unexpected trip after success")
+	} else if !b.failure(now) {
+		t.Fatal("expected trip after two consecutive failures")
+	} else if b.allow(now.Add(time.Second)) {
+		t.Fatal("expected breaker to be open")
+	} else if !b.allow(now.Add(time.Minute)) {
+		t.Fatal("expected breaker to close after cooldown")
+	}
+}
+
+// Ensure a zero threshold disables the breaker.
+func TestBreaker_Disabled(t *testing.T) {
+	b := newBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if b.failure(time.Unix(0, 0)) {
+			t.Fatal("unexpected trip")
+		}
+	}
+}
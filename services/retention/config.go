@@ -1,18 +1,210 @@
 package retention
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/influxdata/influxdb/toml"
 )
 
+// DefaultMetaFailureCooldown is the default period that enforcement is paused
+// for once the meta client circuit breaker trips.
+const DefaultMetaFailureCooldown = 5 * time.Minute
+
+// DefaultShardGroupDeleteConcurrency is the default number of shard groups
+// deleted from the meta store concurrently.
+const DefaultShardGroupDeleteConcurrency = 1
+
+// DefaultErrorLogInterval is the default minimum period between logging
+// repeated occurrences of the same error.
+const DefaultErrorLogInterval = time.Minute
+
+// DefaultEventBufferSize is the default number of events buffered by the
+// channel returned by Service.Events.
+const DefaultEventBufferSize = 100
+
+const (
+	// DefaultMetaRetries is the default number of times a failed meta client
+	// call is retried before the failure is reported.
+	DefaultMetaRetries = 2
+
+	// DefaultMetaRetryDelay is the default base delay between meta client retries.
+	DefaultMetaRetryDelay = 100 * time.Millisecond
+)
+
+// DeletionOrder determines the order in which shards are deleted.
+type DeletionOrder string
+
+const (
+	// DeletionOrderDefault deletes shards in the order the store lists them.
+	DeletionOrderDefault DeletionOrder = ""
+
+	// DeletionOrderOldestFirst deletes shards from the oldest shard groups first.
+	DeletionOrderOldestFirst DeletionOrder = "oldest-first"
+
+	// DeletionOrderNewestFirst deletes shard groups with the most recent start
+	// time first. It applies to shard group deletion only.
+	DeletionOrderNewestFirst DeletionOrder = "newest-first"
+
+	// DeletionOrderLargestFirst deletes the largest shards first. It requires
+	// the store to report shard sizes.
+	DeletionOrderLargestFirst DeletionOrder = "largest-first"
+)
+
 // Config represents the configuration for the retention service.
 type Config struct {
 	Enabled       bool          `toml:"enabled"`
 	CheckInterval toml.Duration `toml:"check-interval"`
+
+	// StartupDelay is how long enforcement waits after the service is opened
+	// before it starts checking, giving the meta store time to settle.
+	StartupDelay toml.Duration `toml:"startup-delay"`
+
+	// MinCheckInterval and MaxCheckInterval bound the check interval. A check
+	// interval outside of them is clamped to the nearest bound, with a
+	// warning. A zero bound, the default, is not enforced.
+	MinCheckInterval toml.Duration `toml:"min-check-interval"`
+	MaxCheckInterval toml.Duration `toml:"max-check-interval"`
+
+	// CompactBeforeDelete compacts each shard immediately before it is
+	// deleted, if the store supports it. tsdb.Store doesn't, so it has no
+	// effect in influxd.
+	CompactBeforeDelete bool `toml:"compact-before-delete"`
+
+	// MetaFailureThreshold is the number of consecutive meta client failures
+	// after which enforcement is paused for MetaFailureCooldown. Zero disables
+	// the circuit breaker.
+	MetaFailureThreshold int           `toml:"meta-failure-threshold"`
+	MetaFailureCooldown  toml.Duration `toml:"meta-failure-cooldown"`
+
+	// MetaRetries is the number of times a failed meta client call is
+	// retried within a pass before it counts as a failure. Retries wait
+	// MetaRetryDelay, doubled after each attempt, plus a random jitter.
+	MetaRetries    int           `toml:"meta-retries"`
+	MetaRetryDelay toml.Duration `toml:"meta-retry-delay"`
+
+	// DeletionOrder is the order in which shards are deleted.
+	DeletionOrder DeletionOrder `toml:"deletion-order"`
+
+	// ShardGroupDeletionOrder is the order in which expired shard groups are
+	// deleted: oldest-first, newest-first, or the meta store's order.
+	ShardGroupDeletionOrder DeletionOrder `toml:"shard-group-deletion-order"`
+
+	// ShardGroupDeleteConcurrency is the maximum number of shard groups
+	// deleted from the meta store at the same time.
+	ShardGroupDeleteConcurrency int `toml:"shard-group-delete-concurrency"`
+
+	// MinDiskFree is the number of free bytes below which the disk is
+	// considered critically full. Shard group deletion is deferred while the
+	// disk is critically full. Zero disables the check.
+	MinDiskFree uint64 `toml:"min-disk-free"`
+
+	// ShardDeleteTimeout is how long the deletion of a single shard may take
+	// before the pass moves on to the next shard. A shard whose deletion
+	// times out is retried by a later pass. Zero disables the timeout.
+	ShardDeleteTimeout toml.Duration `toml:"shard-delete-timeout"`
+
+	// MinKeepShardGroups is the number of most recent shard groups of each
+	// policy that are never deleted, even if they have expired. Zero keeps
+	// none.
+	MinKeepShardGroups int `toml:"min-keep-shard-groups"`
+
+	// DeleteOrphanShards makes Service.Reconcile delete shards that are in
+	// the store but not referenced by any shard group in the meta store. They
+	// are deleted through the same approval, audit and event path as the
+	// shards of deleted shard groups.
+	DeleteOrphanShards bool `toml:"delete-orphan-shards"`
+
+	// ErrorLogInterval is the minimum period between logging repeated
+	// occurrences of the same shard or shard group deletion error. The
+	// number of occurrences that weren't logged is summarized after each
+	// pass. Zero logs every occurrence.
+	ErrorLogInterval toml.Duration `toml:"error-log-interval"`
+
+	// MaxShardDeleteFailures is the number of consecutive passes a shard may
+	// fail to be deleted in before it is no longer retried and is reported
+	// by Service.FailedDeletions instead. Zero retries shards indefinitely.
+	MaxShardDeleteFailures int `toml:"max-shard-delete-failures"`
+
+	// Verbose logs how long each step of a pass takes at debug level.
+	Verbose bool `toml:"verbose"`
+
+	// EventBufferSize is the number of events buffered by the channel
+	// returned by Service.Events. Events are dropped while it is full.
+	EventBufferSize int `toml:"event-buffer-size"`
 }
 
 // NewConfig returns an instance of Config with defaults.
 func NewConfig() Config {
-	return Config{Enabled: true, CheckInterval: toml.Duration(30 * time.Minute)}
+	return Config{
+		Enabled:             true,
+		CheckInterval:       toml.Duration(30 * time.Minute),
+		MetaFailureCooldown: toml.Duration(DefaultMetaFailureCooldown),
+		MetaRetries:         DefaultMetaRetries,
+		MetaRetryDelay:      toml.Duration(DefaultMetaRetryDelay),
+		ErrorLogInterval:    toml.Duration(DefaultErrorLogInterval),
+		EventBufferSize:     DefaultEventBufferSize,
+
+		ShardGroupDeleteConcurrency: DefaultShardGroupDeleteConcurrency,
+	}
+}
+
+// Validate returns an error if the config is invalid. A disabled config is
+// not validated.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.CheckInterval <= 0 {
+		return errors.New("retention check-interval must be positive")
+	} else if c.MinCheckInterval > 0 && c.MaxCheckInterval > 0 && c.MinCheckInterval > c.MaxCheckInterval {
+		return fmt.Errorf("retention min-check-interval %s exceeds max-check-interval %s",
+			time.Duration(c.MinCheckInterval), time.Duration(c.MaxCheckInterval))
+	} else if c.MinCheckInterval < 0 || c.MaxCheckInterval < 0 {
+		return errors.New("retention min-check-interval and max-check-interval must not be negative")
+	} else if c.ShardGroupDeleteConcurrency < 1 {
+		return errors.New("retention shard-group-delete-concurrency must be at least 1")
+	} else if c.StartupDelay < 0 {
+		return errors.New("retention startup-delay must not be negative")
+	} else if c.MinKeepShardGroups < 0 {
+		return errors.New("retention min-keep-shard-groups must not be negative")
+	} else if c.MaxShardDeleteFailures < 0 {
+		return errors.New("retention max-shard-delete-failures must not be negative")
+	} else if c.ErrorLogInterval < 0 {
+		return errors.New("retention error-log-interval must not be negative")
+	} else if c.ShardDeleteTimeout < 0 {
+		return errors.New("retention shard-delete-timeout must not be negative")
+	} else if c.MetaRetries < 0 {
+		return errors.New("retention meta-retries must not be negative")
+	} else if c.MetaRetryDelay < 0 {
+		return errors.New("retention meta-retry-delay must not be negative")
+	} else if c.EventBufferSize < 0 {
+		return errors.New("retention event-buffer-size must not be negative")
+	}
+
+	switch c.DeletionOrder {
+	case DeletionOrderDefault, DeletionOrderOldestFirst, DeletionOrderLargestFirst:
+	default:
+		return fmt.Errorf("invalid retention deletion-order: %q", c.DeletionOrder)
+	}
+
+	switch c.ShardGroupDeletionOrder {
+	case DeletionOrderDefault, DeletionOrderOldestFirst, DeletionOrderNewestFirst:
+	default:
+		return fmt.Errorf("invalid retention shard-group-deletion-order: %q", c.ShardGroupDeletionOrder)
+	}
+	return nil
+}
+
+// checkInterval returns the check interval clamped to the configured bounds.
+func (c Config) checkInterval() time.Duration {
+	d := time.Duration(c.CheckInterval)
+	if min := time.Duration(c.MinCheckInterval); min > 0 && d < min {
+		return min
+	} else if max := time.Duration(c.MaxCheckInterval); max > 0 && d > max {
+		return max
+	}
+	return d
 }
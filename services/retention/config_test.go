@@ -6,6 +6,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/influxdata/influxdb/services/retention"
+	itoml "github.com/influxdata/influxdb/toml"
 )
 
 func TestConfig_Parse(t *testing.T) {
@@ -14,6 +15,7 @@ func TestConfig_Parse(t *testing.T) {
 	if _, err := toml.Decode(`
 enabled = true
 check-interval = "1s"
+compact-before-delete = true
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -23,5 +25,72 @@ check-interval = "1s"
 		t.Fatalf("unexpected enabled state: %v", c.Enabled)
 	} else if time.Duration(c.CheckInterval) != time.Second {
 		t.Fatalf("unexpected check interval: %v", c.CheckInterval)
+	} else if !c.CompactBeforeDelete {
+		t.Fatalf("unexpected compact before delete: %v", c.CompactBeforeDelete)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := retention.NewConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	c.DeletionOrder = "smallest-first"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	c = retention.NewConfig()
+	c.ShardGroupDeletionOrder = retention.DeletionOrderLargestFirst
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected validation error for shard group deletion order")
+	}
+
+	c = retention.NewConfig()
+	c.ShardGroupDeleteConcurrency = 0
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected validation error for shard group delete concurrency")
+	}
+}
+
+func TestConfig_Validate_CheckInterval(t *testing.T) {
+	c := retention.NewConfig()
+	c.MinCheckInterval = itoml.Duration(10 * time.Second)
+	c.MaxCheckInterval = itoml.Duration(24 * time.Hour)
+
+	// Check intervals outside the bounds are clamped rather than rejected.
+	for _, tt := range []struct {
+		interval time.Duration
+		exp      time.Duration
+	}{
+		{interval: time.Second, exp: 10 * time.Second},
+		{interval: 7 * 24 * time.Hour, exp: 24 * time.Hour},
+		{interval: time.Hour, exp: time.Hour},
+	} {
+		c.CheckInterval = itoml.Duration(tt.interval)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: unexpected validation error: %s", tt.interval, err)
+		}
+		s := retention.NewService(c)
+		if v := s.Statistics(nil)[0].Values["checkInterval"]; v != int64(tt.exp) {
+			t.Fatalf("%s: unexpected check interval: %v", tt.interval, v)
+		}
+	}
+
+	c.MinCheckInterval = itoml.Duration(48 * time.Hour)
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for min-check-interval above max-check-interval")
+	}
+}
+
+// Ensure a disabled config isn't validated.
+func TestConfig_Validate_Disabled(t *testing.T) {
+	c := retention.NewConfig()
+	c.Enabled = false
+	c.CheckInterval = 0
+	c.DeletionOrder = "smallest-first"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
 	}
 }
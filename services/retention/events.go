@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what a RetentionEvent reports.
+type EventType string
+
+const (
+	// EventShardGroupDeleted is sent when a shard group is deleted from the
+	// meta store.
+	EventShardGroupDeleted EventType = "shard-group-deleted"
+
+	// EventShardDeleted is sent when a shard is deleted from the store.
+	EventShardDeleted EventType = "shard-deleted"
+
+	// EventError is sent when deleting a shard or shard group, or pruning
+	// the deleted shard groups, fails.
+	EventError EventType = "error"
+)
+
+// RetentionEvent describes a deletion performed by the service, or a failure
+// to perform one.
+type RetentionEvent struct {
+	Time            time.Time
+	Type            EventType
+	Database        string
+	RetentionPolicy string
+
+	// ID is the ID of the shard or shard group. It is zero for errors that
+	// don't concern a single one.
+	ID uint64
+
+	// Err is set for EventError events.
+	Err error
+}
+
+// Events returns a channel receiving an event for every shard and shard group
+// the service deletes and every deletion error. Events are only sent once
+// Events has been called. Sending never blocks enforcement: when the channel
+// is full, events are dropped and counted in the eventsDropped statistic. The
+// channel is closed when the service is closed.
+func (s *Service) Events() <-chan RetentionEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.events == nil {
+		s.events = make(chan RetentionEvent, s.eventBufferSize)
+		if s.eventsClosed {
+			close(s.events)
+		}
+	}
+	return s.events
+}
+
+// emit sends an event to the Events channel, if there is one, or drops it if
+// the channel is full.
+func (s *Service) emit(e RetentionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.events == nil || s.eventsClosed {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddInt64(&s.stats.EventsDropped, 1)
+	}
+}
+
+// closeEvents closes the Events channel. No events are sent afterwards.
+func (s *Service) closeEvents() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.eventsClosed {
+		return
+	}
+	s.eventsClosed = true
+	if s.events != nil {
+		close(s.events)
+	}
+}
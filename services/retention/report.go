@@ -0,0 +1,645 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// PolicyReport describes the configuration of a retention policy along with
+// the deletions the service has performed for it since it was opened.
+// Infinite is set for policies whose data never expires.
+type PolicyReport struct {
+	Database           string
+	RetentionPolicy    string
+	Duration           time.Duration
+	ShardGroupDuration time.Duration
+	ReplicaN           int
+	Infinite           bool
+	ShardGroupsDeleted int64
+	ShardsDeleted      int64
+
+	// BytesFreed is the total size of the deleted shards, as reported by
+	// the store before each was deleted.
+	BytesFreed int64
+}
+
+// Report returns a report for every retention policy known to the meta
+// client, sorted by database and retention policy name.
+func (s *Service) Report() []PolicyReport {
+	var reports []PolicyReport
+	for _, d := range s.MetaClient.Databases() {
+		for _, r := range d.RetentionPolicies {
+			c := s.deletions.get(d.Name, r.Name)
+			reports = append(reports, PolicyReport{
+				Database:           d.Name,
+				RetentionPolicy:    r.Name,
+				Duration:           r.Duration,
+				ShardGroupDuration: r.ShardGroupDuration,
+				ReplicaN:           r.ReplicaN,
+				Infinite:           r.Duration == 0,
+				ShardGroupsDeleted: c.shardGroups,
+				ShardsDeleted:      c.shards,
+				BytesFreed:         c.bytes,
+			})
+		}
+	}
+	sort.Sort(policyReports(reports))
+	return reports
+}
+
+// PolicyBacklog describes a retention policy whose expired shard groups have
+// not been deleted yet.
+type PolicyBacklog struct {
+	Database           string
+	RetentionPolicy    string
+	ExpiredShardGroups int
+
+	// OldestEndTime is the end time of the oldest expired shard group.
+	OldestEndTime time.Time
+}
+
+// OverRetained returns the retention policies holding more than threshold
+// expired shard groups, which indicates that deletion isn't keeping up with
+// expiry. Policies are sorted by database and retention policy name.
+func (s *Service) OverRetained(threshold int) []PolicyBacklog {
+	now := time.Now().UTC()
+
+	var backlogs []PolicyBacklog
+	for _, d := range s.MetaClient.Databases() {
+		for _, r := range d.RetentionPolicies {
+			if r.Duration == 0 {
+				continue
+			}
+
+			groups := r.ExpiredShardGroups(now)
+			if len(groups) <= threshold {
+				continue
+			}
+
+			b := PolicyBacklog{
+				Database:           d.Name,
+				RetentionPolicy:    r.Name,
+				ExpiredShardGroups: len(groups),
+			}
+			for _, g := range groups {
+				if b.OldestEndTime.IsZero() || g.EndTime.Before(b.OldestEndTime) {
+					b.OldestEndTime = g.EndTime
+				}
+			}
+			backlogs = append(backlogs, b)
+		}
+	}
+	sort.Sort(policyBacklogs(backlogs))
+	return backlogs
+}
+
+// policyBacklogs sorts backlogs by database and retention policy name.
+type policyBacklogs []PolicyBacklog
+
+func (a policyBacklogs) Len() int      { return len(a) }
+func (a policyBacklogs) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a policyBacklogs) Less(i, j int) bool {
+	if a[i].Database != a[j].Database {
+		return a[i].Database < a[j].Database
+	}
+	return a[i].RetentionPolicy < a[j].RetentionPolicy
+}
+
+// ProjectedDeletion describes a shard group that is expected to be deleted
+// by a given time.
+type ProjectedDeletion struct {
+	Database        string
+	RetentionPolicy string
+	ShardGroupID    uint64
+	StartTime       time.Time
+	EndTime         time.Time
+	Shards          int
+
+	// ExpiresAt is the time the shard group expires, after which it is
+	// deleted by the next check. It is in the past for shard groups that
+	// have already expired.
+	ExpiresAt time.Time
+}
+
+// Simulate returns the shard groups that will have expired by until, given
+// the current retention policies and shard groups, without deleting
+// anything. Shard groups that are protected or kept by min-keep-shard-groups
+// are excluded. The deletions are sorted by expiry time.
+func (s *Service) Simulate(until time.Time) []ProjectedDeletion {
+	var deletions []ProjectedDeletion
+	for _, d := range s.MetaClient.Databases() {
+		for _, r := range d.RetentionPolicies {
+			if r.Duration == 0 {
+				continue
+			}
+
+			keep := s.keptShardGroups(r)
+			for _, g := range r.ExpiredShardGroups(until) {
+				if keep[g.ID] || s.shardGroupProtected(g.ID) {
+					continue
+				}
+				deletions = append(deletions, ProjectedDeletion{
+					Database:        d.Name,
+					RetentionPolicy: r.Name,
+					ShardGroupID:    g.ID,
+					StartTime:       g.StartTime,
+					EndTime:         g.EndTime,
+					Shards:          len(g.Shards),
+					ExpiresAt:       g.EndTime.Add(r.Duration),
+				})
+			}
+		}
+	}
+	sort.Sort(projectedDeletions(deletions))
+	return deletions
+}
+
+// projectedDeletions sorts deletions by expiry time and shard group ID.
+type projectedDeletions []ProjectedDeletion
+
+func (a projectedDeletions) Len() int      { return len(a) }
+func (a projectedDeletions) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a projectedDeletions) Less(i, j int) bool {
+	if !a[i].ExpiresAt.Equal(a[j].ExpiresAt) {
+		return a[i].ExpiresAt.Before(a[j].ExpiresAt)
+	}
+	return a[i].ShardGroupID < a[j].ShardGroupID
+}
+
+// ShardStatus describes the retention status of a shard in the store.
+type ShardStatus struct {
+	ID              uint64        `json:"id"`
+	Database        string        `json:"database,omitempty"`
+	RetentionPolicy string        `json:"retentionPolicy,omitempty"`
+	PendingDeletion bool          `json:"pendingDeletion"`
+	Age             time.Duration `json:"age"`
+}
+
+// ShardStatuses returns the retention status of every shard in the store,
+// sorted by ID. A shard is pending deletion if its shard group has been
+// deleted or has expired. Shards unknown to the meta store have no database
+// or retention policy.
+func (s *Service) ShardStatuses() []ShardStatus {
+	now := time.Now().UTC()
+
+	known := make(map[uint64]ShardStatus)
+	for _, d := range s.MetaClient.Databases() {
+		for _, r := range d.RetentionPolicies {
+			expired := make(map[uint64]bool)
+			if r.Duration != 0 {
+				for _, g := range r.ExpiredShardGroups(now) {
+					expired[g.ID] = true
+				}
+			}
+
+			for _, g := range r.ShardGroups {
+				for _, sh := range g.Shards {
+					known[sh.ID] = ShardStatus{
+						ID:              sh.ID,
+						Database:        d.Name,
+						RetentionPolicy: r.Name,
+						PendingDeletion: g.Deleted() || expired[g.ID],
+						Age:             now.Sub(g.StartTime),
+					}
+				}
+			}
+		}
+	}
+
+	ids := s.TSDBStore.ShardIDs()
+	sort.Sort(shardIDs{ids: ids, less: func(a, b uint64) bool { return a < b }})
+
+	statuses := make([]ShardStatus, 0, len(ids))
+	for _, id := range ids {
+		st, ok := known[id]
+		if !ok {
+			st = ShardStatus{ID: id}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// ReconcileReport describes how the shards in the store differ from the
+// shards referenced by the meta store.
+type ReconcileReport struct {
+	// Orphans are the IDs of shards in the store that no shard group refers
+	// to. DeletedOrphans are those of them that were deleted.
+	Orphans        []uint64 `json:"orphans"`
+	DeletedOrphans []uint64 `json:"deletedOrphans,omitempty"`
+
+	// Missing are the shards referenced by a shard group that aren't in the
+	// store.
+	Missing []MissingShard `json:"missing"`
+}
+
+// MissingShard is a shard referenced by the meta store that isn't in the
+// store.
+type MissingShard struct {
+	ID              uint64 `json:"id"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	ShardGroupID    uint64 `json:"shardGroupID"`
+}
+
+// Reconcile compares the shards in the store with those referenced by the
+// meta store. Shards of deleted shard groups are expected to be removed from
+// the store by the service and are neither orphans nor missing. Nothing is
+// deleted unless delete-orphan-shards is set, in which case orphans are
+// deleted like the shards of deleted shard groups: subject to ShardFilter and
+// DeleteShardApprover, which is passed an empty database and retention
+// policy, and recorded by the AuditWriter and Events. The first deletion
+// error is returned along with the report.
+func (s *Service) Reconcile() (ReconcileReport, error) {
+	var report ReconcileReport
+
+	ids := s.TSDBStore.ShardIDs()
+	local := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		local[id] = true
+	}
+
+	known := make(map[uint64]bool)
+	for _, d := range s.MetaClient.Databases() {
+		for _, r := range d.RetentionPolicies {
+			for _, g := range r.ShardGroups {
+				for _, sh := range g.Shards {
+					known[sh.ID] = true
+					if !g.Deleted() && !local[sh.ID] {
+						report.Missing = append(report.Missing, MissingShard{
+							ID:              sh.ID,
+							Database:        d.Name,
+							RetentionPolicy: r.Name,
+							ShardGroupID:    g.ID,
+						})
+					}
+				}
+			}
+		}
+	}
+	sort.Sort(missingShards(report.Missing))
+
+	for _, id := range ids {
+		if !known[id] {
+			report.Orphans = append(report.Orphans, id)
+		}
+	}
+	sort.Sort(shardIDs{ids: report.Orphans, less: func(a, b uint64) bool { return a < b }})
+
+	if !s.deleteOrphans {
+		return report, nil
+	}
+
+	var err error
+	for _, id := range report.Orphans {
+		if s.ShardFilter != nil && !s.ShardFilter(id) {
+			s.logger.Debug(fmt.Sprintf("orphan shard ID %d excluded by filter", id))
+			continue
+		}
+		ok, e := s.deleteShard(id, deletionInfo{})
+		if e != nil && err == nil {
+			err = e
+		}
+		if ok {
+			report.DeletedOrphans = append(report.DeletedOrphans, id)
+		}
+	}
+	return report, err
+}
+
+// SelfTest exercises the service's dependencies without deleting anything.
+// It lists the databases, scans them for expired shard groups and lists the
+// shards in the store, then logs how many shard groups and shards the next
+// passes would delete. An error is returned if a dependency is missing.
+// Databases and ShardIDs don't report errors, so a dependency that is
+// present but unhealthy isn't detected.
+func (s *Service) SelfTest() error {
+	if s.MetaClient == nil {
+		return ErrNoMetaClient
+	} else if s.TSDBStore == nil {
+		return ErrNoTSDBStore
+	}
+
+	dbs := s.MetaClient.Databases()
+
+	now := time.Now().UTC()
+	var groups int
+	deleted := make(map[uint64]bool)
+	for _, d := range dbs {
+		for _, r := range d.RetentionPolicies {
+			if r.Duration != 0 {
+				keep := s.keptShardGroups(r)
+				for _, g := range r.ExpiredShardGroups(now) {
+					if !s.shardGroupProtected(g.ID) && !keep[g.ID] {
+						groups++
+					}
+				}
+			}
+			for _, g := range r.DeletedShardGroups() {
+				for _, sh := range g.Shards {
+					deleted[sh.ID] = true
+				}
+			}
+		}
+	}
+
+	var shards int
+	for _, id := range s.TSDBStore.ShardIDs() {
+		if deleted[id] && (s.ShardFilter == nil || s.ShardFilter(id)) {
+			shards++
+		}
+	}
+
+	s.logger.Info(fmt.Sprintf("retention self-test passed: %d databases, %d shard groups and %d shards would be deleted",
+		len(dbs), groups, shards))
+	return nil
+}
+
+// missingShards sorts missing shards by ID.
+type missingShards []MissingShard
+
+func (a missingShards) Len() int           { return len(a) }
+func (a missingShards) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a missingShards) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// TimeRange is the time between Start, inclusive, and End, exclusive.
+type TimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// CoverageGaps returns the time ranges within the retention window of a
+// policy that no shard group covers, in order. Only the gaps between shard
+// groups are reported, not those before the first or after the last. The
+// retention window of an infinite policy has no start. Deleted shard groups
+// are ignored. An empty rp selects the default retention policy of db.
+func (s *Service) CoverageGaps(db, rp string) ([]TimeRange, error) {
+	var rpi *meta.RetentionPolicyInfo
+	dbs := s.MetaClient.Databases()
+	for i := range dbs {
+		if dbs[i].Name != db {
+			continue
+		}
+		if rpi = dbs[i].RetentionPolicy(rp); rpi == nil {
+			return nil, meta.ErrRetentionPolicyNotFound
+		}
+		break
+	}
+	if rpi == nil {
+		return nil, meta.ErrDatabaseNotExists
+	}
+
+	var groups []meta.ShardGroupInfo
+	for _, g := range rpi.ShardGroups {
+		if !g.Deleted() {
+			groups = append(groups, g)
+		}
+	}
+	sort.Sort(shardGroupsByStart(groups))
+
+	now := time.Now().UTC()
+	var windowStart time.Time
+	if rpi.Duration != 0 {
+		windowStart = now.Add(-rpi.Duration)
+	}
+
+	var gaps []TimeRange
+	var covered time.Time
+	for i, g := range groups {
+		if i > 0 && g.StartTime.After(covered) {
+			gap := TimeRange{Start: covered, End: g.StartTime}
+			if gap.Start.Before(windowStart) {
+				gap.Start = windowStart
+			}
+			if gap.End.After(now) {
+				gap.End = now
+			}
+			if gap.Start.Before(gap.End) {
+				gaps = append(gaps, gap)
+			}
+		}
+
+		end := g.EndTime
+		if g.Truncated() {
+			end = g.TruncatedAt
+		}
+		if i == 0 || end.After(covered) {
+			covered = end
+		}
+	}
+	return gaps, nil
+}
+
+// shardGroupsByStart sorts shard groups by start time.
+type shardGroupsByStart []meta.ShardGroupInfo
+
+func (a shardGroupsByStart) Len() int           { return len(a) }
+func (a shardGroupsByStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a shardGroupsByStart) Less(i, j int) bool { return a[i].StartTime.Before(a[j].StartTime) }
+
+// FailedShard is a shard that the service has given up deleting.
+type FailedShard struct {
+	ID              uint64 `json:"id"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	Failures        int    `json:"failures"`
+	LastError       string `json:"lastError"`
+}
+
+// failedShards sorts failed shards by ID.
+type failedShards []FailedShard
+
+func (a failedShards) Len() int           { return len(a) }
+func (a failedShards) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a failedShards) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// policyReports sorts reports by database and retention policy name.
+type policyReports []PolicyReport
+
+func (a policyReports) Len() int      { return len(a) }
+func (a policyReports) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a policyReports) Less(i, j int) bool {
+	if a[i].Database != a[j].Database {
+		return a[i].Database < a[j].Database
+	}
+	return a[i].RetentionPolicy < a[j].RetentionPolicy
+}
+
+// policyKey identifies a retention policy.
+type policyKey struct {
+	db, rp string
+}
+
+// policyKeys sorts policy keys by database and retention policy name.
+type policyKeys []policyKey
+
+func (a policyKeys) Len() int      { return len(a) }
+func (a policyKeys) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a policyKeys) Less(i, j int) bool {
+	if a[i].db != a[j].db {
+		return a[i].db < a[j].db
+	}
+	return a[i].rp < a[j].rp
+}
+
+// deletionCounts holds the number of deletions performed for a policy and
+// the number of bytes they freed.
+type deletionCounts struct {
+	shardGroups int64
+	shards      int64
+	bytes       int64
+}
+
+// deletionTracker counts deletions per retention policy.
+type deletionTracker struct {
+	mu     sync.Mutex
+	counts map[policyKey]deletionCounts
+}
+
+// get returns the deletion counts for a policy.
+func (t *deletionTracker) get(db, rp string) deletionCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[policyKey{db, rp}]
+}
+
+// shardGroupDeleted records the deletion of a shard group.
+func (t *deletionTracker) shardGroupDeleted(db, rp string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = make(map[policyKey]deletionCounts)
+	}
+	c := t.counts[policyKey{db, rp}]
+	c.shardGroups++
+	t.counts[policyKey{db, rp}] = c
+}
+
+// shardDeleted records the deletion of a shard of the given size.
+func (t *deletionTracker) shardDeleted(db, rp string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = make(map[policyKey]deletionCounts)
+	}
+	c := t.counts[policyKey{db, rp}]
+	c.shards++
+	c.bytes += size
+	t.counts[policyKey{db, rp}] = c
+}
+
+// all returns a copy of the deletion counts of every policy.
+func (t *deletionTracker) all() map[policyKey]deletionCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[policyKey]deletionCounts, len(t.counts))
+	for k, c := range t.counts {
+		m[k] = c
+	}
+	return m
+}
+
+// deletionRateWindow is the number of recent shard deletion passes the
+// deletion rate is averaged over.
+const deletionRateWindow = 10
+
+// deletionPass is the number of shards a pass deleted and how long it spent
+// deleting them.
+type deletionPass struct {
+	shards  int64
+	elapsed time.Duration
+}
+
+// deletionRate tracks the shard deletion rate of recent passes.
+type deletionRate struct {
+	mu     sync.Mutex
+	passes []deletionPass
+}
+
+// add records a pass, discarding the oldest once the window is full.
+func (r *deletionRate) add(shards int64, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.passes = append(r.passes, deletionPass{shards: shards, elapsed: elapsed})
+	if len(r.passes) > deletionRateWindow {
+		r.passes = r.passes[len(r.passes)-deletionRateWindow:]
+	}
+}
+
+// perSecond returns the average number of shards deleted per second over the
+// recent passes, or zero if nothing has been deleted.
+func (r *deletionRate) perSecond() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var shards int64
+	var elapsed time.Duration
+	for _, p := range r.passes {
+		shards += p.shards
+		elapsed += p.elapsed
+	}
+	if shards == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(shards) / elapsed.Seconds()
+}
+
+// passIntervalWindow is the number of recent intervals between the starts of
+// shard deletion passes that schedule drift is measured over.
+const passIntervalWindow = 10
+
+// passIntervals tracks the time between the starts of successive passes.
+type passIntervals struct {
+	mu        sync.Mutex
+	last      time.Time
+	intervals []time.Duration
+}
+
+// start records the start of a pass, discarding the oldest interval once the
+// window is full.
+func (p *passIntervals) start(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.last.IsZero() {
+		p.intervals = append(p.intervals, now.Sub(p.last))
+		if len(p.intervals) > passIntervalWindow {
+			p.intervals = p.intervals[len(p.intervals)-passIntervalWindow:]
+		}
+	}
+	p.last = now
+}
+
+// stats returns the average and maximum of the recent intervals, or zero if
+// fewer than two passes have started.
+func (p *passIntervals) stats() (avg, max time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.intervals) == 0 {
+		return 0, 0
+	}
+	var sum time.Duration
+	for _, d := range p.intervals {
+		sum += d
+		if d > max {
+			max = d
+		}
+	}
+	return sum / time.Duration(len(p.intervals)), max
+}
+
+// DeletionETA estimates how long it will take to delete the shards left in
+// the store by the last pass, based on the average deletion rate of recent
+// passes. It returns zero if there is no backlog, or if no shard has been
+// deleted yet so the rate is unknown.
+func (s *Service) DeletionETA() time.Duration {
+	backlog := atomic.LoadInt64(&s.stats.DeletionBacklog)
+	rate := s.rate.perSecond()
+	if backlog == 0 || rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(backlog) / rate * float64(time.Second))
+}
@@ -0,0 +1,46 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure the deletion rate is averaged over the most recent passes only.
+func TestDeletionRate(t *testing.T) {
+	var r deletionRate
+	if v := r.perSecond(); v != 0 {
+		t.Fatalf("unexpected rate without passes: %f", v)
+	}
+
+	r.add(100, time.Second)
+	for i := 0; i < deletionRateWindow; i++ {
+		r.add(10, time.Second)
+	}
+	if v := r.perSecond(); v != 10 {
+		t.Fatalf("unexpected rate: %f", v)
+	}
+}
+
+// Ensure the intervals between pass starts are measured over recent passes only.
+func TestPassIntervals(t *testing.T) {
+	var p passIntervals
+	now := time.Unix(0, 0)
+	p.start(now)
+	if avg, max := p.stats(); avg != 0 || max != 0 {
+		t.Fatalf("unexpected intervals after one pass: %s, %s", avg, max)
+	}
+
+	now = now.Add(time.Hour)
+	p.start(now)
+	for i := 0; i < passIntervalWindow; i++ {
+		if i%2 == 0 {
+			now = now.Add(time.Second)
+		} else {
+			now = now.Add(3 * time.Second)
+		}
+		p.start(now)
+	}
+	if avg, max := p.stats(); avg != 2*time.Second || max != 3*time.Second {
+		t.Fatalf("unexpected intervals: %s, %s", avg, max)
+	}
+}
@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// errorSampler limits how often the same error is logged. The first
+// occurrence of an error is logged, and after that at most one occurrence per
+// interval. Occurrences that aren't logged are counted so they can be
+// summarized.
+type errorSampler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	errors   map[string]*sampledError
+}
+
+// sampledError tracks the occurrences of a single error.
+type sampledError struct {
+	logged     time.Time
+	suppressed int
+}
+
+// newErrorSampler returns a sampler which logs each distinct error at most
+// once per interval. An interval of zero returns a sampler which logs every
+// error.
+func newErrorSampler(interval time.Duration) *errorSampler {
+	return &errorSampler{interval: interval, errors: make(map[string]*sampledError)}
+}
+
+// allow records an occurrence of the error and returns true if it should be
+// logged, along with the number of occurrences suppressed since the error was
+// last logged or summarized.
+func (s *errorSampler) allow(msg string, now time.Time) (bool, int) {
+	if s.interval <= 0 {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.errors[msg]
+	if !ok {
+		s.errors[msg] = &sampledError{logged: now}
+		return true, 0
+	} else if now.Sub(e.logged) < s.interval {
+		e.suppressed++
+		return false, 0
+	}
+
+	n := e.suppressed
+	e.logged, e.suppressed = now, 0
+	return true, n
+}
+
+// suppressedError is an error along with the number of its occurrences that
+// weren't logged.
+type suppressedError struct {
+	msg   string
+	count int
+}
+
+// flush returns the errors with suppressed occurrences, sorted by message,
+// and resets their counts. Errors which haven't occurred within the interval
+// are forgotten.
+func (s *errorSampler) flush(now time.Time) []suppressedError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var a []suppressedError
+	for msg, e := range s.errors {
+		if e.suppressed > 0 {
+			a = append(a, suppressedError{msg: msg, count: e.suppressed})
+			e.suppressed = 0
+		} else if now.Sub(e.logged) >= s.interval {
+			delete(s.errors, msg)
+		}
+	}
+	sort.Sort(suppressedErrors(a))
+	return a
+}
+
+// suppressedErrors sorts suppressed errors by message.
+type suppressedErrors []suppressedError
+
+func (a suppressedErrors) Len() int           { return len(a) }
+func (a suppressedErrors) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a suppressedErrors) Less(i, j int) bool { return a[i].msg < a[j].msg }
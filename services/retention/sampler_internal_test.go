@@ -0,0 +1,44 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Ensure repeated errors are logged at most once per interval and the rest are counted.
+func TestErrorSampler(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newErrorSampler(time.Minute)
+
+	if ok, _ := s.allow("a", now); !ok {
+		t.Fatal("expected first occurrence to be logged")
+	} else if ok, _ := s.allow("b", now); !ok {
+		t.Fatal("expected first occurrence of another error to be logged")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.allow("a", now.Add(time.Second)); ok {
+			t.Fatal("expected repeated occurrence to be suppressed")
+		}
+	}
+	if ok, n := s.allow("a", now.Add(time.Minute)); !ok || n != 3 {
+		t.Fatalf("unexpected result after interval: %v, %d", ok, n)
+	}
+
+	s.allow("a", now.Add(time.Minute+time.Second))
+	if a := s.flush(now.Add(2 * time.Minute)); !reflect.DeepEqual(a, []suppressedError{{msg: "a", count: 1}}) {
+		t.Fatalf("unexpected suppressed errors: %+v", a)
+	} else if _, ok := s.errors["b"]; ok {
+		t.Fatal("expected stale error to be forgotten")
+	}
+}
+
+// Ensure a zero interval logs every error.
+func TestErrorSampler_Disabled(t *testing.T) {
+	s := newErrorSampler(0)
+	for i := 0; i < 10; i++ {
+		if ok, _ := s.allow("a", time.Unix(0, 0)); !ok {
+			t.Fatal("unexpected suppression")
+		}
+	}
+}
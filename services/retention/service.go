@@ -2,14 +2,60 @@
 package retention // import "github.com/influxdata/influxdb/services/retention"
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/services/meta"
 	"go.uber.org/zap"
 )
 
+// ErrNoMetaClient and ErrNoTSDBStore are returned by Open when the service's
+// MetaClient or TSDBStore hasn't been set.
+var (
+	ErrNoMetaClient = errors.New("retention service has no meta client")
+	ErrNoTSDBStore  = errors.New("retention service has no store")
+)
+
+// ErrPassInProgress is returned by EnforceContext when a pass of the same
+// kind is already running.
+var ErrPassInProgress = errors.New("retention pass already in progress")
+
+// errShardDeleteTimeout is returned when deleting a shard takes longer than
+// the configured timeout.
+var errShardDeleteTimeout = errors.New("shard deletion timed out")
+
+// errShardStillExists is recorded when a shard is still in the store after it
+// was deleted.
+var errShardStillExists = errors.New("shard still exists after deletion")
+
+// Statistics for the retention service.
+const (
+	statGoroutines      = "goroutines"
+	statDeletionBacklog = "deletionBacklog"
+	statDeletionETA     = "deletionETA"
+	statEventsDropped   = "eventsDropped"
+	statCheckInterval   = "checkInterval"
+	statPassIntervalAvg = "passIntervalAvg"
+	statPassIntervalMax = "passIntervalMax"
+	statDiskFree        = "diskFree"
+	statDiskTotal       = "diskTotal"
+	statPassesDeferred  = "passesDeferred"
+
+	// Per retention policy statistics.
+	statShardGroupsDeleted = "shardGroupsDeleted"
+	statShardsDeleted      = "shardsDeleted"
+	statBytesFreed         = "bytesFreed"
+)
+
 // Service represents the retention policy enforcement service.
 type Service struct {
 	MetaClient interface {
@@ -22,37 +68,186 @@ type Service struct {
 		DeleteShard(shardID uint64) error
 	}
 
-	enabled       bool
-	checkInterval time.Duration
-	wg            sync.WaitGroup
-	done          chan struct{}
+	// Deleter, if set, performs the deletion of shards and shard groups in
+	// place of TSDBStore and MetaClient. Everything else is still read from
+	// them.
+	Deleter ShardDeleter
+
+	// ShardFilter, if set, restricts shard deletion to the shards for which
+	// it returns true.
+	ShardFilter func(id uint64) bool
+
+	// DeleteShardApprover, if set, is consulted immediately before each shard
+	// is deleted. Shards for which it returns false are skipped.
+	DeleteShardApprover func(db, rp string, shardID uint64) bool
+
+	// DiskUsage, if set, returns the free and total bytes of the disk holding
+	// the shards. It is used to detect when the disk is critically full, and
+	// the last values returned are reported in the statistics. A total of
+	// zero means the usage couldn't be determined.
+	DiskUsage func() (free, total uint64)
+
+	// OnStall, if set along with MaxSilence, is called by a watchdog when no
+	// shard deletion pass has completed within MaxSilence. lastRun is the
+	// time the last pass completed, or the time the service was opened.
+	MaxSilence time.Duration
+	OnStall    func(lastRun time.Time)
+
+	// ProgressFunc, if set, is called after each shard a pass attempts to
+	// delete, with the number of shards handled so far and the total for
+	// the pass.
+	ProgressFunc func(done, total int)
+
+	// AuditWriter, if set, receives a JSON line for every shard and shard
+	// group the service deletes.
+	AuditWriter io.Writer
+
+	// ShardNotFoundError, if set, is the error the store's DeleteShard
+	// returns when the shard doesn't exist. Such shards are considered
+	// already deleted rather than failed.
+	ShardNotFoundError error
+
+	enabled             bool
+	checkInterval       time.Duration
+	configuredInterval  time.Duration
+	compactBeforeDelete bool
+	deletionOrder       DeletionOrder
+	groupConcurrency    int
+	minDiskFree         uint64
+	minKeepShardGroups  int
+	groupDeletionOrder  DeletionOrder
+	startupDelay        time.Duration
+	metaRetries         int
+	metaRetryDelay      time.Duration
+	shardDeleteTimeout  time.Duration
+	deleteOrphans       bool
+	maxShardFailures    int
+	verbose             bool
+	eventBufferSize     int
+	breaker             *breaker
+	errors              *errorSampler
+	deletions           deletionTracker
+	rate                deletionRate
+	intervals           passIntervals
+	stats               *Statistics
+	wg                  sync.WaitGroup
+	done                chan struct{}
+
+	// shardGroupPass and shardPass are set while a shard group or shard
+	// deletion pass is running, so that passes never overlap.
+	shardGroupPass int32
+	shardPass      int32
+
+	// mu protects lastRun, protected, deleting, failures, events and writes
+	// to AuditWriter.
+	mu        sync.Mutex
+	lastRun   time.Time
+	protected map[uint64]bool
+
+	// deleting holds the shards whose deletion timed out but is still running.
+	deleting map[uint64]bool
+
+	// failures holds the shards whose most recent deletions failed.
+	failures map[uint64]*FailedShard
+
+	// events is the channel returned by Events, created on its first call.
+	events       chan RetentionEvent
+	eventsClosed bool
 
 	logger zap.Logger
 }
 
+// ShardDeleter deletes shards from the store and shard groups from the meta
+// store.
+type ShardDeleter interface {
+	DeleteShard(shardID uint64) error
+	DeleteShardGroup(database, policy string, id uint64) error
+}
+
+// storeDeleter is the default ShardDeleter, which deletes shards from the
+// service's TSDBStore and shard groups from its MetaClient.
+type storeDeleter struct {
+	s *Service
+}
+
+// DeleteShard implements ShardDeleter.
+func (d storeDeleter) DeleteShard(shardID uint64) error {
+	return d.s.TSDBStore.DeleteShard(shardID)
+}
+
+// DeleteShardGroup implements ShardDeleter.
+func (d storeDeleter) DeleteShardGroup(database, policy string, id uint64) error {
+	return d.s.MetaClient.DeleteShardGroup(database, policy, id)
+}
+
+// deleter returns the ShardDeleter used by the service.
+func (s *Service) deleter() ShardDeleter {
+	if s.Deleter != nil {
+		return s.Deleter
+	}
+	return storeDeleter{s: s}
+}
+
 // NewService returns a configured retention policy enforcement service.
 func NewService(c Config) *Service {
 	return &Service{
-		checkInterval: time.Duration(c.CheckInterval),
-		done:          make(chan struct{}),
-		logger:        zap.New(zap.NullEncoder()),
+		checkInterval:       c.checkInterval(),
+		configuredInterval:  time.Duration(c.CheckInterval),
+		compactBeforeDelete: c.CompactBeforeDelete,
+		deletionOrder:       c.DeletionOrder,
+		groupConcurrency:    c.ShardGroupDeleteConcurrency,
+		minDiskFree:         c.MinDiskFree,
+		minKeepShardGroups:  c.MinKeepShardGroups,
+		groupDeletionOrder:  c.ShardGroupDeletionOrder,
+		startupDelay:        time.Duration(c.StartupDelay),
+		metaRetries:         c.MetaRetries,
+		metaRetryDelay:      time.Duration(c.MetaRetryDelay),
+		shardDeleteTimeout:  time.Duration(c.ShardDeleteTimeout),
+		deleteOrphans:       c.DeleteOrphanShards,
+		maxShardFailures:    c.MaxShardDeleteFailures,
+		verbose:             c.Verbose,
+		eventBufferSize:     c.EventBufferSize,
+		breaker:             newBreaker(c.MetaFailureThreshold, time.Duration(c.MetaFailureCooldown)),
+		errors:              newErrorSampler(time.Duration(c.ErrorLogInterval)),
+		stats:               &Statistics{},
+		done:                make(chan struct{}),
+		logger:              zap.New(zap.NullEncoder()),
 	}
 }
 
-// Open starts retention policy enforcement.
+// Open starts retention policy enforcement. An error is returned if the
+// MetaClient or TSDBStore hasn't been set.
 func (s *Service) Open() error {
+	if s.MetaClient == nil {
+		return ErrNoMetaClient
+	} else if s.TSDBStore == nil {
+		return ErrNoTSDBStore
+	}
+
 	s.logger.Info(fmt.Sprint("Starting retention policy enforcement service with check interval of ", s.checkInterval))
+	if s.checkInterval != s.configuredInterval {
+		s.logger.Info(fmt.Sprintf("retention check-interval %s is outside the configured bounds, using %s",
+			s.configuredInterval, s.checkInterval))
+	}
+	s.setLastRun(time.Now())
 	s.wg.Add(2)
 	go s.deleteShardGroups()
 	go s.deleteShards()
+
+	if s.MaxSilence > 0 && s.OnStall != nil {
+		s.wg.Add(1)
+		go s.watchdog()
+	}
 	return nil
 }
 
-// Close stops retention policy enforcement.
+// Close stops retention policy enforcement. It waits for shard deletions
+// that timed out to finish, so that none runs against a closed store.
 func (s *Service) Close() error {
 	s.logger.Info("retention policy enforcement terminating")
 	close(s.done)
 	s.wg.Wait()
+	s.closeEvents()
 	return nil
 }
 
@@ -61,9 +256,91 @@ func (s *Service) WithLogger(log zap.Logger) {
 	s.logger = log.With(zap.String("service", "retention"))
 }
 
+// Statistics maintains the statistics for the retention service.
+type Statistics struct {
+	Goroutines int64
+
+	// DeletionBacklog is the number of shards of deleted shard groups that
+	// remained in the store after the last shard deletion pass.
+	DeletionBacklog int64
+
+	// EventsDropped is the number of events that weren't sent because the
+	// Events channel was full.
+	EventsDropped int64
+
+	// DiskFree and DiskTotal are the free and total bytes of the disk
+	// holding the shards when it was last checked.
+	DiskFree  int64
+	DiskTotal int64
+
+	// PassesDeferred is the number of shard group deletion passes deferred
+	// because the disk was critically full.
+	PassesDeferred int64
+}
+
+// Statistics returns statistics for periodic monitoring. Along with the
+// service statistics, it returns the deletions performed for each retention
+// policy, tagged with the database and retention policy.
+//
+// The average and maximum time between the starts of recent shard deletion
+// passes are reported alongside the check interval. Intervals well above the
+// check interval mean that enforcement is falling behind its schedule.
+func (s *Service) Statistics(tags map[string]string) []models.Statistic {
+	avg, max := s.intervals.stats()
+	statistics := []models.Statistic{{
+		Name: "retention",
+		Tags: tags,
+		Values: map[string]interface{}{
+			statGoroutines:      atomic.LoadInt64(&s.stats.Goroutines),
+			statDeletionBacklog: atomic.LoadInt64(&s.stats.DeletionBacklog),
+			statDeletionETA:     int64(s.DeletionETA()),
+			statEventsDropped:   atomic.LoadInt64(&s.stats.EventsDropped),
+			statCheckInterval:   int64(s.checkInterval),
+			statPassIntervalAvg: int64(avg),
+			statPassIntervalMax: int64(max),
+			statDiskFree:        atomic.LoadInt64(&s.stats.DiskFree),
+			statDiskTotal:       atomic.LoadInt64(&s.stats.DiskTotal),
+			statPassesDeferred:  atomic.LoadInt64(&s.stats.PassesDeferred),
+		},
+	}}
+
+	counts := s.deletions.all()
+	keys := make([]policyKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Sort(policyKeys(keys))
+
+	for _, k := range keys {
+		c := counts[k]
+		statistics = append(statistics, models.Statistic{
+			Name: "retention",
+			Tags: models.StatisticTags{"database": k.db, "retention_policy": k.rp}.Merge(tags),
+			Values: map[string]interface{}{
+				statShardGroupsDeleted: c.shardGroups,
+				statShardsDeleted:      c.shards,
+				statBytesFreed:         c.bytes,
+			},
+		})
+	}
+	return statistics
+}
+
+// GoroutineCount returns the number of enforcement goroutines running.
+func (s *Service) GoroutineCount() int {
+	return int(atomic.LoadInt64(&s.stats.Goroutines))
+}
+
 func (s *Service) deleteShardGroups() {
 	defer s.wg.Done()
 
+	atomic.AddInt64(&s.stats.Goroutines, 1)
+	defer atomic.AddInt64(&s.stats.Goroutines, -1)
+
+	if !s.waitStartupDelay() {
+		return
+	}
+
 	ticker := time.NewTicker(s.checkInterval)
 	defer ticker.Stop()
 	for {
@@ -72,27 +349,222 @@ func (s *Service) deleteShardGroups() {
 			return
 
 		case <-ticker.C:
-			dbs := s.MetaClient.Databases()
-			for _, d := range dbs {
-				for _, r := range d.RetentionPolicies {
-					for _, g := range r.ExpiredShardGroups(time.Now().UTC()) {
-						if err := s.MetaClient.DeleteShardGroup(d.Name, r.Name, g.ID); err != nil {
-							s.logger.Info(fmt.Sprintf("failed to delete shard group %d from database %s, retention policy %s: %s",
-								g.ID, d.Name, r.Name, err.Error()))
-						} else {
-							s.logger.Info(fmt.Sprintf("deleted shard group %d from database %s, retention policy %s",
-								g.ID, d.Name, r.Name))
-						}
-					}
+			if !s.breaker.allow(time.Now()) {
+				continue
+			}
+			s.enforceShardGroups(context.Background())
+		}
+	}
+}
+
+// waitStartupDelay waits for the configured startup delay to pass. It
+// returns false if the service is closed in the meantime.
+func (s *Service) waitStartupDelay() bool {
+	if s.startupDelay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(s.startupDelay)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// EnforceContext runs a shard group deletion pass followed by a shard
+// deletion pass, as the background loops do, and returns once both are done.
+// The context is checked before each shard group and shard is deleted; if it
+// is cancelled, the pass stops and ctx.Err() is returned. ErrPassInProgress
+// is returned if a pass is already running, and the pruning error if the
+// deleted shard groups can't be pruned.
+func (s *Service) EnforceContext(ctx context.Context) error {
+	if err := s.enforceShardGroups(ctx); err != nil {
+		return err
+	}
+	return s.enforceShards(ctx)
+}
+
+// enforceShardGroups marks all expired shard groups as deleted in the meta
+// store. Up to groupConcurrency shard groups are deleted at the same time.
+// Shard groups are no longer dispatched once ctx is cancelled.
+func (s *Service) enforceShardGroups(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.shardGroupPass, 0, 1) {
+		s.logger.Info("skipping shard group deletion check, previous pass still running")
+		return ErrPassInProgress
+	}
+	defer atomic.StoreInt32(&s.shardGroupPass, 0)
+	defer s.logSuppressedErrors()
+
+	if s.diskFull() {
+		s.logger.Info("deferring shard group deletion until disk space is available")
+		atomic.AddInt64(&s.stats.PassesDeferred, 1)
+		return nil
+	}
+
+	n := s.groupConcurrency
+	if n < 1 {
+		n = 1
+	}
+	throttle := make(chan struct{}, n)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// tripped is set once a failure trips the circuit breaker.
+	var tripped int32
+
+	start := time.Now()
+	dbs := s.MetaClient.Databases()
+	s.logTiming("shard group meta lookup", start)
+
+	start = time.Now()
+	var groups []expiredGroup
+	for _, d := range dbs {
+		for _, r := range d.RetentionPolicies {
+			// Shard groups of infinite policies never expire.
+			if r.Duration == 0 {
+				s.logger.Debug(fmt.Sprintf("retention policy %s on database %s has infinite duration, skipping",
+					r.Name, d.Name))
+				continue
+			}
+
+			keep := s.keptShardGroups(r)
+			for _, g := range r.ExpiredShardGroups(time.Now().UTC()) {
+				if s.shardGroupProtected(g.ID) {
+					s.logger.Info(fmt.Sprintf("keeping expired shard group %d from database %s, retention policy %s, as it is protected",
+						g.ID, d.Name, r.Name))
+					continue
+				} else if keep[g.ID] {
+					s.logger.Debug(fmt.Sprintf("keeping expired shard group %d from database %s, retention policy %s, as one of the %d most recent",
+						g.ID, d.Name, r.Name, s.minKeepShardGroups))
+					continue
 				}
+				groups = append(groups, expiredGroup{db: d.Name, rp: r.Name, id: g.ID, start: g.StartTime})
 			}
 		}
 	}
+
+	switch s.groupDeletionOrder {
+	case DeletionOrderOldestFirst:
+		sort.Stable(expiredGroups{groups: groups, newestFirst: false})
+	case DeletionOrderNewestFirst:
+		sort.Stable(expiredGroups{groups: groups, newestFirst: true})
+	}
+	s.logTiming(fmt.Sprintf("expiry scan of %d shard groups", len(groups)), start)
+
+	start = time.Now()
+	defer func() {
+		wg.Wait()
+		s.logTiming(fmt.Sprintf("deletion of %d shard groups", len(groups)), start)
+	}()
+
+	for _, g := range groups {
+		throttle <- struct{}{}
+
+		// Stop dispatching once the circuit breaker has tripped or the
+		// context is cancelled.
+		if atomic.LoadInt32(&tripped) == 1 {
+			<-throttle
+			return nil
+		} else if err := ctx.Err(); err != nil {
+			<-throttle
+			s.logger.Info(fmt.Sprintf("shard group deletion check stopped: %s", err))
+			return err
+		}
+
+		wg.Add(1)
+		go func(g expiredGroup) {
+			defer wg.Done()
+			defer func() { <-throttle }()
+			if !s.deleteShardGroup(g.db, g.rp, g.id) {
+				atomic.StoreInt32(&tripped, 1)
+			}
+		}(g)
+	}
+	return nil
+}
+
+// expiredGroup is an expired shard group to be deleted.
+type expiredGroup struct {
+	db    string
+	rp    string
+	id    uint64
+	start time.Time
+}
+
+// expiredGroups sorts expired shard groups by start time.
+type expiredGroups struct {
+	groups      []expiredGroup
+	newestFirst bool
+}
+
+// Len implements sort.Interface.
+func (a expiredGroups) Len() int { return len(a.groups) }
+
+// Less implements sort.Interface.
+func (a expiredGroups) Less(i, j int) bool {
+	if a.newestFirst {
+		return a.groups[i].start.After(a.groups[j].start)
+	}
+	return a.groups[i].start.Before(a.groups[j].start)
+}
+
+// Swap implements sort.Interface.
+func (a expiredGroups) Swap(i, j int) { a.groups[i], a.groups[j] = a.groups[j], a.groups[i] }
+
+// keptShardGroups returns the IDs of the most recent shard groups of the
+// policy that must not be deleted, even if they have expired.
+func (s *Service) keptShardGroups(r meta.RetentionPolicyInfo) map[uint64]bool {
+	if s.minKeepShardGroups <= 0 {
+		return nil
+	}
+
+	var groups []meta.ShardGroupInfo
+	for _, g := range r.ShardGroups {
+		if !g.Deleted() {
+			groups = append(groups, g)
+		}
+	}
+	sort.Sort(sort.Reverse(meta.ShardGroupInfos(groups)))
+
+	keep := make(map[uint64]bool, s.minKeepShardGroups)
+	for i := 0; i < len(groups) && i < s.minKeepShardGroups; i++ {
+		keep[groups[i].ID] = true
+	}
+	return keep
+}
+
+// deleteShardGroup marks a single shard group as deleted in the meta store.
+// It returns false if a failure tripped the circuit breaker.
+func (s *Service) deleteShardGroup(db, rp string, id uint64) bool {
+	if err := s.retryMeta(func() error { return s.deleter().DeleteShardGroup(db, rp, id) }); err != nil {
+		s.logError(err, fmt.Sprintf("failed to delete shard group %d from database %s, retention policy %s",
+			id, db, rp))
+		s.emit(RetentionEvent{Type: EventError, Database: db, RetentionPolicy: rp, ID: id, Err: err})
+		return !s.metaFailed()
+	}
+	s.breaker.success()
+	s.deletions.shardGroupDeleted(db, rp)
+	s.audit("shard-group", db, rp, id)
+	s.emit(RetentionEvent{Type: EventShardGroupDeleted, Database: db, RetentionPolicy: rp, ID: id})
+	s.logger.Info(fmt.Sprintf("deleted shard group %d from database %s, retention policy %s",
+		id, db, rp))
+	return true
 }
 
 func (s *Service) deleteShards() {
 	defer s.wg.Done()
 
+	atomic.AddInt64(&s.stats.Goroutines, 1)
+	defer atomic.AddInt64(&s.stats.Goroutines, -1)
+
+	if !s.waitStartupDelay() {
+		return
+	}
+
 	ticker := time.NewTicker(s.checkInterval)
 	defer ticker.Stop()
 	for {
@@ -101,38 +573,607 @@ func (s *Service) deleteShards() {
 			return
 
 		case <-ticker.C:
-			s.logger.Info("retention policy shard deletion check commencing")
-
-			type deletionInfo struct {
-				db string
-				rp string
+			if !s.breaker.allow(time.Now()) {
+				continue
 			}
-			deletedShardIDs := make(map[uint64]deletionInfo, 0)
-			dbs := s.MetaClient.Databases()
-			for _, d := range dbs {
-				for _, r := range d.RetentionPolicies {
-					for _, g := range r.DeletedShardGroups() {
-						for _, sh := range g.Shards {
-							deletedShardIDs[sh.ID] = deletionInfo{db: d.Name, rp: r.Name}
-						}
-					}
+			s.intervals.start(time.Now())
+			s.enforceShards(context.Background())
+		}
+	}
+}
+
+// enforceShards removes the shards of all deleted shard groups from the store
+// and prunes the deleted shard groups from the meta store. If ctx is cancelled,
+// the pass stops before the next shard and nothing is pruned.
+func (s *Service) enforceShards(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.shardPass, 0, 1) {
+		s.logger.Info("skipping shard deletion check, previous pass still running")
+		return ErrPassInProgress
+	}
+	defer atomic.StoreInt32(&s.shardPass, 0)
+	defer s.logSuppressedErrors()
+
+	s.logger.Info("retention policy shard deletion check commencing")
+	if s.diskFull() {
+		// Deleting shards frees space, so proceed regardless.
+		s.logger.Info("deleting shards while disk is critically full")
+	}
+
+	start := time.Now()
+	dbs := s.MetaClient.Databases()
+	s.logTiming("shard meta lookup", start)
+
+	start = time.Now()
+	deletedShardIDs := make(map[uint64]deletionInfo, 0)
+	for _, d := range dbs {
+		for _, r := range d.RetentionPolicies {
+			for _, g := range r.DeletedShardGroups() {
+				for _, sh := range g.Shards {
+					deletedShardIDs[sh.ID] = deletionInfo{db: d.Name, rp: r.Name, start: g.StartTime}
 				}
 			}
+		}
+	}
 
-			for _, id := range s.TSDBStore.ShardIDs() {
-				if di, ok := deletedShardIDs[id]; ok {
-					if err := s.TSDBStore.DeleteShard(id); err != nil {
-						s.logger.Info(fmt.Sprintf("failed to delete shard ID %d from database %s, retention policy %s: %s",
-							id, di.db, di.rp, err.Error()))
-						continue
-					}
-					s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, deleted",
-						id, di.db, di.rp))
-				}
+	var ids []uint64
+	for _, id := range s.TSDBStore.ShardIDs() {
+		di, ok := deletedShardIDs[id]
+		if !ok {
+			continue
+		} else if s.ShardFilter != nil && !s.ShardFilter(id) {
+			s.logger.Debug(fmt.Sprintf("shard ID %d from database %s, retention policy %s, excluded by filter",
+				id, di.db, di.rp))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	s.sortShards(ids, deletedShardIDs)
+	s.pruneShardFailures(ids)
+	s.logTiming(fmt.Sprintf("scan of %d deleted shards", len(ids)), start)
+
+	start = time.Now()
+	var backlog int64
+	var cancelled error
+	for i, id := range ids {
+		if cancelled = ctx.Err(); cancelled != nil {
+			backlog += int64(len(ids) - i)
+			break
+		}
+		if ok, _ := s.deleteShard(id, deletedShardIDs[id]); !ok {
+			backlog++
+		}
+		if s.ProgressFunc != nil {
+			s.ProgressFunc(i+1, len(ids))
+		}
+	}
+	atomic.StoreInt64(&s.stats.DeletionBacklog, backlog)
+	if len(ids) > 0 {
+		s.rate.add(int64(len(ids))-backlog, time.Since(start))
+	}
+	s.logTiming(fmt.Sprintf("deletion of %d shards", len(ids)), start)
+	if cancelled != nil {
+		s.logger.Info(fmt.Sprintf("shard deletion check stopped: %s", cancelled))
+		return cancelled
+	}
+
+	start = time.Now()
+	if err := s.retryMeta(s.MetaClient.PruneShardGroups); err != nil {
+		s.logger.Info(fmt.Sprintf("error pruning shard groups: %s", err))
+		s.emit(RetentionEvent{Type: EventError, Err: err})
+		s.metaFailed()
+		return err
+	}
+	s.logTiming("shard group pruning", start)
+	s.breaker.success()
+	s.setLastRun(time.Now())
+	return nil
+}
+
+// deleteShard deletes a single shard of a deleted shard group, or an orphan
+// shard if di has no database. It returns false if the shard is still in the
+// store, along with the error if the deletion itself failed. Shards that are
+// skipped, e.g. because their deletion wasn't approved, return no error.
+func (s *Service) deleteShard(id uint64, di deletionInfo) (bool, error) {
+	if s.DeleteShardApprover != nil && !s.DeleteShardApprover(di.db, di.rp, id) {
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, deletion not approved",
+			id, di.db, di.rp))
+		return false, nil
+	}
+	if s.shardGivenUp(id) {
+		s.logger.Debug(fmt.Sprintf("shard ID %d from database %s, retention policy %s, failed too many times, not deleting",
+			id, di.db, di.rp))
+		return false, nil
+	}
+	if s.shardDeleting(id) {
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, is still being deleted",
+			id, di.db, di.rp))
+		return false, nil
+	}
+	if s.shardOwned(id) {
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, belongs to a live shard group, not deleting",
+			id, di.db, di.rp))
+		return false, nil
+	}
+	if s.compactBeforeDelete {
+		s.compactShard(id)
+	}
+	size := s.shardSize(id)
+	if err := s.deleteShardWithTimeout(id); err != nil && err == s.ShardNotFoundError {
+		s.shardSucceeded(id)
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, already deleted",
+			id, di.db, di.rp))
+		return true, nil
+	} else if err != nil {
+		s.logError(err, fmt.Sprintf("failed to delete shard ID %d from database %s, retention policy %s",
+			id, di.db, di.rp))
+		s.shardFailed(id, di, err)
+		s.emit(RetentionEvent{Type: EventError, Database: di.db, RetentionPolicy: di.rp, ID: id, Err: err})
+		return false, err
+	}
+	if s.shardExists(id) {
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, still exists after deletion",
+			id, di.db, di.rp))
+		s.shardFailed(id, di, errShardStillExists)
+		s.emit(RetentionEvent{Type: EventError, Database: di.db, RetentionPolicy: di.rp, ID: id, Err: errShardStillExists})
+		return false, errShardStillExists
+	}
+	s.shardSucceeded(id)
+	if di.db != "" {
+		s.deletions.shardDeleted(di.db, di.rp, size)
+	}
+	s.audit("shard", di.db, di.rp, id)
+	s.emit(RetentionEvent{Type: EventShardDeleted, Database: di.db, RetentionPolicy: di.rp, ID: id})
+	s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, deleted",
+		id, di.db, di.rp))
+	return true, nil
+}
+
+// deleteShardWithTimeout deletes the shard from the store. If the deletion
+// takes longer than the configured timeout, errShardDeleteTimeout is returned
+// and the deletion is left to finish in the background. The shard is skipped
+// by later passes until it does, and Close waits for it.
+func (s *Service) deleteShardWithTimeout(id uint64) error {
+	if s.shardDeleteTimeout <= 0 {
+		return s.deleter().DeleteShard(id)
+	}
+
+	errC := make(chan error, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		errC <- s.deleter().DeleteShard(id)
+		s.mu.Lock()
+		delete(s.deleting, id)
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(s.shardDeleteTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errC:
+		return err
+	case <-timer.C:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// The deletion may have finished since the timer fired.
+		select {
+		case err := <-errC:
+			return err
+		default:
+		}
+		if s.deleting == nil {
+			s.deleting = make(map[uint64]bool)
+		}
+		s.deleting[id] = true
+		return errShardDeleteTimeout
+	}
+}
+
+// shardDeleting returns true if an earlier deletion of the shard timed out
+// and is still running.
+func (s *Service) shardDeleting(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleting[id]
+}
+
+// shardFailed records a failed deletion of the shard. Once the shard has
+// failed maxShardFailures times in a row it is no longer retried.
+func (s *Service) shardFailed(id uint64, di deletionInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == nil {
+		s.failures = make(map[uint64]*FailedShard)
+	}
+	f, ok := s.failures[id]
+	if !ok {
+		f = &FailedShard{ID: id, Database: di.db, RetentionPolicy: di.rp}
+		s.failures[id] = f
+	}
+	f.Failures++
+	f.LastError = err.Error()
+
+	if s.maxShardFailures > 0 && f.Failures == s.maxShardFailures {
+		s.logger.Info(fmt.Sprintf("shard ID %d from database %s, retention policy %s, failed to be deleted %d times, giving up: %s",
+			id, di.db, di.rp, f.Failures, f.LastError))
+	}
+}
+
+// shardSucceeded clears the failures recorded for the shard.
+func (s *Service) shardSucceeded(id uint64) {
+	s.mu.Lock()
+	delete(s.failures, id)
+	s.mu.Unlock()
+}
+
+// shardGivenUp returns true if the shard has failed to be deleted too many
+// times to be retried.
+func (s *Service) shardGivenUp(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.failures[id]
+	return ok && s.maxShardFailures > 0 && f.Failures >= s.maxShardFailures
+}
+
+// pruneShardFailures forgets the failures of shards that are no longer
+// pending deletion, such as those removed by hand.
+func (s *Service) pruneShardFailures(pending []uint64) {
+	ids := make(map[uint64]bool, len(pending))
+	for _, id := range pending {
+		ids[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.failures {
+		if !ids[id] {
+			delete(s.failures, id)
+		}
+	}
+}
+
+// FailedDeletions returns the shards that failed to be deleted too many times
+// in a row and are no longer retried, sorted by ID. It is empty unless
+// max-shard-delete-failures is set.
+func (s *Service) FailedDeletions() []FailedShard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxShardFailures <= 0 {
+		return nil
+	}
+
+	var a []FailedShard
+	for _, f := range s.failures {
+		if f.Failures >= s.maxShardFailures {
+			a = append(a, *f)
+		}
+	}
+	sort.Sort(failedShards(a))
+	return a
+}
+
+// watchdog calls OnStall whenever no shard deletion pass has completed
+// within MaxSilence.
+func (s *Service) watchdog() {
+	defer s.wg.Done()
+
+	atomic.AddInt64(&s.stats.Goroutines, 1)
+	defer atomic.AddInt64(&s.stats.Goroutines, -1)
+
+	ticker := time.NewTicker(s.MaxSilence)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case now := <-ticker.C:
+			if lastRun := s.getLastRun(); now.Sub(lastRun) > s.MaxSilence {
+				s.logger.Info(fmt.Sprintf("no retention policy enforcement pass has completed since %s", lastRun))
+				s.OnStall(lastRun)
 			}
-			if err := s.MetaClient.PruneShardGroups(); err != nil {
-				s.logger.Info(fmt.Sprintf("error pruning shard groups: %s", err))
+		}
+	}
+}
+
+// ProtectShardGroups protects the shard groups with the given IDs from
+// deletion, even once they expire, until they are unprotected.
+func (s *Service) ProtectShardGroups(ids ...uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.protected == nil {
+		s.protected = make(map[uint64]bool)
+	}
+	for _, id := range ids {
+		s.protected[id] = true
+	}
+}
+
+// UnprotectShardGroups allows the shard groups with the given IDs to be
+// deleted again once they expire.
+func (s *Service) UnprotectShardGroups(ids ...uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.protected, id)
+	}
+}
+
+// ProtectedShardGroups returns the sorted IDs of the protected shard groups.
+func (s *Service) ProtectedShardGroups() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint64, 0, len(s.protected))
+	for id := range s.protected {
+		ids = append(ids, id)
+	}
+	sort.Sort(shardIDs{ids: ids, less: func(a, b uint64) bool { return a < b }})
+	return ids
+}
+
+// shardGroupProtected returns true if the shard group is protected from deletion.
+func (s *Service) shardGroupProtected(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protected[id]
+}
+
+// setLastRun records the time a shard deletion pass completed.
+func (s *Service) setLastRun(t time.Time) {
+	s.mu.Lock()
+	s.lastRun = t
+	s.mu.Unlock()
+}
+
+// getLastRun returns the time the last shard deletion pass completed.
+func (s *Service) getLastRun() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRun
+}
+
+// deletionInfo describes the shard group a shard to be deleted belongs to.
+type deletionInfo struct {
+	db    string
+	rp    string
+	start time.Time
+}
+
+// shardSizer is implemented by stores that can report the size of a shard.
+type shardSizer interface {
+	ShardSize(id uint64) (int64, error)
+}
+
+// shardSize returns the size of the shard, or zero if the store doesn't
+// report shard sizes or the size can't be determined.
+func (s *Service) shardSize(id uint64) int64 {
+	sizer, ok := s.TSDBStore.(shardSizer)
+	if !ok {
+		return 0
+	}
+	n, err := sizer.ShardSize(id)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// sortShards sorts the shard IDs according to the configured deletion order.
+func (s *Service) sortShards(ids []uint64, infos map[uint64]deletionInfo) {
+	switch s.deletionOrder {
+	case DeletionOrderOldestFirst:
+		sort.Stable(shardIDs{ids: ids, less: func(a, b uint64) bool {
+			return infos[a].start.Before(infos[b].start)
+		}})
+	case DeletionOrderLargestFirst:
+		sizer, ok := s.TSDBStore.(shardSizer)
+		if !ok {
+			s.logger.Info("store does not report shard sizes, deleting shards in default order")
+			return
+		}
+		sizes := make(map[uint64]int64, len(ids))
+		for _, id := range ids {
+			// Shards whose size can't be determined are deleted last.
+			if n, err := sizer.ShardSize(id); err == nil {
+				sizes[id] = n
 			}
 		}
+		sort.Stable(shardIDs{ids: ids, less: func(a, b uint64) bool {
+			return sizes[a] > sizes[b]
+		}})
+	}
+}
+
+// shardIDs sorts shard IDs using a comparison function.
+type shardIDs struct {
+	ids  []uint64
+	less func(a, b uint64) bool
+}
+
+// Len implements sort.Interface.
+func (a shardIDs) Len() int { return len(a.ids) }
+
+// Less implements sort.Interface.
+func (a shardIDs) Less(i, j int) bool { return a.less(a.ids[i], a.ids[j]) }
+
+// Swap implements sort.Interface.
+func (a shardIDs) Swap(i, j int) { a.ids[i], a.ids[j] = a.ids[j], a.ids[i] }
+
+// retryMeta calls fn, retrying up to the configured number of times while it
+// fails. Each retry waits the retry delay, doubled after every attempt, plus
+// a random jitter so concurrent callers don't retry in lockstep. The last
+// error is returned if every attempt fails or the service is closed.
+func (s *Service) retryMeta(fn func() error) error {
+	err := fn()
+	delay := s.metaRetryDelay
+	for i := 0; err != nil && i < s.metaRetries; i++ {
+		wait := delay
+		if delay > 0 {
+			wait += time.Duration(rand.Int63n(int64(delay)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		s.logger.Debug(fmt.Sprintf("retrying meta client call after error: %s", err))
+		err = fn()
+		delay *= 2
+	}
+	return err
+}
+
+// logTiming logs how long a step of a pass took, if verbose logging is
+// enabled.
+func (s *Service) logTiming(step string, start time.Time) {
+	if s.verbose {
+		s.logger.Debug(fmt.Sprintf("retention %s took %s", step, time.Since(start)))
+	}
+}
+
+// logError logs msg along with err, unless err has already been logged
+// within the error log interval.
+func (s *Service) logError(err error, msg string) {
+	ok, n := s.errors.allow(err.Error(), time.Now())
+	if !ok {
+		return
+	} else if n > 0 {
+		s.logger.Info(fmt.Sprintf("%s: %s (%d similar errors suppressed)", msg, err.Error(), n))
+		return
+	}
+	s.logger.Info(fmt.Sprintf("%s: %s", msg, err.Error()))
+}
+
+// logSuppressedErrors logs the number of occurrences of each error that
+// weren't logged since the last summary.
+func (s *Service) logSuppressedErrors() {
+	for _, e := range s.errors.flush(time.Now()) {
+		s.logger.Info(fmt.Sprintf("suppressed %d occurrences of error: %s", e.count, e.msg))
+	}
+}
+
+// metaFailed records a failed meta client call. It returns true if the
+// failure tripped the circuit breaker, in which case the current pass
+// should be abandoned.
+func (s *Service) metaFailed() bool {
+	if !s.breaker.failure(time.Now()) {
+		return false
+	}
+	s.logger.Info(fmt.Sprintf("meta client failed %d consecutive times, pausing retention policy enforcement for %s",
+		s.breaker.threshold, s.breaker.cooldown))
+	return true
+}
+
+// shardOwner is implemented by meta clients that can look up the shard group
+// a shard belongs to. Only shard groups that haven't been deleted are
+// considered.
+type shardOwner interface {
+	ShardOwner(shardID uint64) (database, policy string, sgi *meta.ShardGroupInfo)
+}
+
+// shardOwned returns true if a fresh meta lookup finds the shard in a shard
+// group that hasn't been deleted. Shards are listed for deletion from a
+// snapshot of the meta data taken at the start of a pass, so this guards
+// against the meta data changing before the shard is deleted. Meta clients
+// that can't look up shards are trusted to be consistent with the snapshot.
+func (s *Service) shardOwned(id uint64) bool {
+	owner, ok := s.MetaClient.(shardOwner)
+	if !ok {
+		return false
+	}
+	_, _, sgi := owner.ShardOwner(id)
+	return sgi != nil
+}
+
+// shardCompactor is implemented by stores that can compact a single shard.
+type shardCompactor interface {
+	CompactShard(id uint64) error
+}
+
+// compactShard compacts the shard if the store supports it. Stores that don't
+// implement CompactShard are left untouched.
+func (s *Service) compactShard(id uint64) {
+	c, ok := s.TSDBStore.(shardCompactor)
+	if !ok {
+		return
+	}
+	if err := c.CompactShard(id); err != nil {
+		s.logger.Info(fmt.Sprintf("failed to compact shard ID %d before deletion: %s", id, err.Error()))
+	}
+}
+
+// shardChecker is implemented by stores that can report whether a shard is
+// still present.
+type shardChecker interface {
+	ShardExists(id uint64) bool
+}
+
+// shardExists returns true if the store reports that the shard is still
+// present. Stores that don't implement ShardExists are assumed to have
+// deleted it.
+func (s *Service) shardExists(id uint64) bool {
+	c, ok := s.TSDBStore.(shardChecker)
+	return ok && c.ShardExists(id)
+}
+
+// diskFull returns true if the free disk space is below the configured
+// minimum. The disk state is logged and recorded in the statistics whenever
+// it is checked.
+func (s *Service) diskFull() bool {
+	if s.DiskUsage == nil {
+		return false
+	}
+
+	free, total := s.DiskUsage()
+	if total == 0 {
+		s.logger.Debug("disk usage is unknown")
+		return false
+	}
+	atomic.StoreInt64(&s.stats.DiskFree, int64(free))
+	atomic.StoreInt64(&s.stats.DiskTotal, int64(total))
+
+	if s.minDiskFree == 0 || free >= s.minDiskFree {
+		s.logger.Debug(fmt.Sprintf("disk has %d of %d bytes free", free, total))
+		return false
+	}
+	s.logger.Info(fmt.Sprintf("disk is critically full: %d of %d bytes free, minimum is %d",
+		free, total, s.minDiskFree))
+	return true
+}
+
+// auditRecord is a line written to the AuditWriter for each deletion.
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	Type            string    `json:"type"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retention_policy"`
+	ID              uint64    `json:"id"`
+}
+
+// audit writes a record of a deletion to the AuditWriter, if one is set.
+func (s *Service) audit(typ, db, rp string, id uint64) {
+	if s.AuditWriter == nil {
+		return
+	}
+
+	b, err := json.Marshal(auditRecord{
+		Time:            time.Now().UTC(),
+		Type:            typ,
+		Database:        db,
+		RetentionPolicy: rp,
+		ID:              id,
+	})
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("failed to encode audit record: %s", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.AuditWriter.Write(append(b, '\n')); err != nil {
+		s.logger.Info(fmt.Sprintf("failed to write audit record: %s", err))
 	}
 }
@@ -0,0 +1,2212 @@
+package retention_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/toml"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/services/retention"
+	"go.uber.org/zap"
+)
+
+// Ensure the report includes the configuration of every retention policy.
+func TestService_Report(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{
+				{
+					Name: "db1",
+					RetentionPolicies: []meta.RetentionPolicyInfo{
+						{Name: "rp1", ReplicaN: 1, Duration: time.Hour, ShardGroupDuration: time.Minute},
+					},
+				},
+				{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{
+						{Name: "rp0", ReplicaN: 3, Duration: 24 * time.Hour, ShardGroupDuration: time.Hour},
+						{Name: "autogen", ReplicaN: 1, ShardGroupDuration: 7 * 24 * time.Hour},
+					},
+				},
+			}
+		},
+	}
+
+	exp := []retention.PolicyReport{
+		{Database: "db0", RetentionPolicy: "autogen", ShardGroupDuration: 7 * 24 * time.Hour, ReplicaN: 1, Infinite: true},
+		{Database: "db0", RetentionPolicy: "rp0", Duration: 24 * time.Hour, ShardGroupDuration: time.Hour, ReplicaN: 3},
+		{Database: "db1", RetentionPolicy: "rp1", Duration: time.Hour, ShardGroupDuration: time.Minute, ReplicaN: 1},
+	}
+	if got := s.Report(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected report:\n\ngot=%+v\n\nexp=%+v", got, exp)
+	}
+}
+
+// Ensure policies with a backlog of expired shard groups are reported.
+func TestService_OverRetained(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{
+					{
+						Name:     "rp0",
+						Duration: time.Hour,
+						ShardGroups: []meta.ShardGroupInfo{
+							{ID: 1, EndTime: time.Unix(20, 0)},
+							{ID: 2, EndTime: time.Unix(10, 0)},
+							{ID: 3, EndTime: time.Now().Add(time.Hour)},
+						},
+					},
+					{
+						Name:        "rp1",
+						Duration:    time.Hour,
+						ShardGroups: []meta.ShardGroupInfo{{ID: 4, EndTime: time.Unix(0, 0)}},
+					},
+				},
+			}}
+		},
+	}
+
+	exp := []retention.PolicyBacklog{
+		{Database: "db0", RetentionPolicy: "rp0", ExpiredShardGroups: 2, OldestEndTime: time.Unix(10, 0)},
+	}
+	if got := s.OverRetained(1); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected backlog:\n\ngot=%+v\n\nexp=%+v", got, exp)
+	}
+}
+
+// Ensure the shard groups that will expire by a given time are projected.
+func TestService_Simulate(t *testing.T) {
+	now := time.Now().UTC()
+
+	s := retention.NewService(retention.NewConfig())
+	s.ProtectShardGroups(4)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{
+					{
+						Name:     "rp0",
+						Duration: 24 * time.Hour,
+						ShardGroups: []meta.ShardGroupInfo{
+							{ID: 1, EndTime: now.Add(-48 * time.Hour), Shards: []meta.ShardInfo{{ID: 10}}},
+							{ID: 2, EndTime: now.Add(24 * time.Hour)},
+							{ID: 3, EndTime: now.Add(-12 * time.Hour)},
+							{ID: 4, EndTime: now.Add(-48 * time.Hour)},
+							{ID: 5, EndTime: now.Add(-48 * time.Hour), DeletedAt: now},
+						},
+					},
+					{
+						Name: "autogen",
+						ShardGroups: []meta.ShardGroupInfo{
+							{ID: 6, EndTime: now.Add(-48 * time.Hour)},
+						},
+					},
+				},
+			}}
+		},
+	}
+
+	deletions := s.Simulate(now.Add(24 * time.Hour))
+	if len(deletions) != 2 {
+		t.Fatalf("unexpected deletions: %+v", deletions)
+	}
+	exp := retention.ProjectedDeletion{
+		Database:        "db0",
+		RetentionPolicy: "rp0",
+		ShardGroupID:    1,
+		EndTime:         now.Add(-48 * time.Hour),
+		Shards:          1,
+		ExpiresAt:       now.Add(-24 * time.Hour),
+	}
+	if !reflect.DeepEqual(deletions[0], exp) {
+		t.Fatalf("unexpected deletion:\n\ngot=%+v\n\nexp=%+v", deletions[0], exp)
+	} else if deletions[1].ShardGroupID != 3 || !deletions[1].ExpiresAt.Equal(now.Add(12*time.Hour)) {
+		t.Fatalf("unexpected deletion: %+v", deletions[1])
+	}
+}
+
+// Ensure the retention status of every shard in the store is reported.
+func TestService_ShardStatuses(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 1}}},
+						{ID: 2, StartTime: time.Now(), EndTime: time.Now().Add(time.Hour), Shards: []meta.ShardInfo{{ID: 2}}},
+					},
+				}},
+			}}
+		},
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{3, 2, 1} },
+	}
+
+	statuses := s.ShardStatuses()
+	if len(statuses) != 3 {
+		t.Fatalf("unexpected statuses: %+v", statuses)
+	} else if st := statuses[0]; st.ID != 1 || st.Database != "db0" || st.RetentionPolicy != "rp0" || !st.PendingDeletion {
+		t.Fatalf("unexpected status for expired shard: %+v", st)
+	} else if st := statuses[1]; st.ID != 2 || st.PendingDeletion || st.Age > time.Minute {
+		t.Fatalf("unexpected status for current shard: %+v", st)
+	} else if st := statuses[2]; st.ID != 3 || st.Database != "" {
+		t.Fatalf("unexpected status for unknown shard: %+v", st)
+	}
+}
+
+// Ensure shards that differ between the store and meta are reported, and
+// orphans are only deleted when enabled.
+func TestService_Reconcile(t *testing.T) {
+	for _, deleteOrphans := range []bool{false, true} {
+		c := retention.NewConfig()
+		c.DeleteOrphanShards = deleteOrphans
+
+		s := retention.NewService(c)
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{
+							{ID: 1, Shards: []meta.ShardInfo{{ID: 1}, {ID: 2}}},
+							{ID: 2, DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 3}, {ID: 4}}},
+							{ID: 3, Shards: []meta.ShardInfo{{ID: 5}}},
+						},
+					}},
+				}}
+			},
+		}
+
+		var deleted []uint64
+		s.TSDBStore = &TSDBStore{
+			ShardIDsFn: func() []uint64 { return []uint64{7, 1, 3, 6} },
+			DeleteShardFn: func(shardID uint64) error {
+				deleted = append(deleted, shardID)
+				return nil
+			},
+		}
+
+		report, err := s.Reconcile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report.Orphans, []uint64{6, 7}) {
+			t.Fatalf("unexpected orphans: %v", report.Orphans)
+		}
+		exp := []retention.MissingShard{
+			{ID: 2, Database: "db0", RetentionPolicy: "rp0", ShardGroupID: 1},
+			{ID: 5, Database: "db0", RetentionPolicy: "rp0", ShardGroupID: 3},
+		}
+		if !reflect.DeepEqual(report.Missing, exp) {
+			t.Fatalf("unexpected missing shards: %+v", report.Missing)
+		}
+
+		if !deleteOrphans {
+			if len(deleted) != 0 || len(report.DeletedOrphans) != 0 {
+				t.Fatalf("unexpected deletions: %v", deleted)
+			}
+		} else if !reflect.DeepEqual(deleted, []uint64{6, 7}) || !reflect.DeepEqual(report.DeletedOrphans, deleted) {
+			t.Fatalf("unexpected deletions: %v (%v)", deleted, report.DeletedOrphans)
+		}
+	}
+}
+
+// Ensure orphans are deleted through the approval and audit path.
+func TestService_Reconcile_DeleteOrphans(t *testing.T) {
+	c := retention.NewConfig()
+	c.DeleteOrphanShards = true
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo { return nil },
+	}
+
+	var deleted []uint64
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{6, 7, 8} },
+		DeleteShardFn: func(shardID uint64) error {
+			if shardID == 8 {
+				return errors.New("disk on fire")
+			}
+			deleted = append(deleted, shardID)
+			return nil
+		},
+	}
+	s.DeleteShardApprover = func(db, rp string, shardID uint64) bool {
+		return shardID != 6
+	}
+	var audit bytes.Buffer
+	s.AuditWriter = &audit
+
+	report, err := s.Reconcile()
+	if err == nil || err.Error() != "disk on fire" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !reflect.DeepEqual(deleted, []uint64{7}) || !reflect.DeepEqual(report.DeletedOrphans, deleted) {
+		t.Fatalf("unexpected deletions: %v (%v)", deleted, report.DeletedOrphans)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected audit records: %q", audit.String())
+	}
+	var rec struct {
+		Type string `json:"type"`
+		ID   uint64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	} else if rec.Type != "shard" || rec.ID != 7 {
+		t.Fatalf("unexpected audit record: %s", lines[0])
+	}
+}
+
+// Ensure the self-test calls the dependencies without deleting anything.
+func TestService_SelfTest(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, StartTime: time.Unix(0, 0), EndTime: time.Unix(1, 0), Shards: []meta.ShardInfo{{ID: 1}}},
+						{ID: 2, DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 2}}},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			t.Fatalf("unexpected deletion of shard group %d", id)
+			return nil
+		},
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{1, 2} },
+		DeleteShardFn: func(shardID uint64) error {
+			t.Fatalf("unexpected deletion of shard %d", shardID)
+			return nil
+		},
+	}
+
+	if err := s.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing dependency is reported.
+	s.TSDBStore = nil
+	if err := s.SelfTest(); err == nil {
+		t.Fatal("expected error for missing store")
+	}
+}
+
+// Ensure the gaps between shard groups within the retention window are reported.
+func TestService_CoverageGaps(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	at := func(h int) time.Time { return now.Add(time.Duration(h) * time.Hour) }
+
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name:                   "db0",
+				DefaultRetentionPolicy: "rp0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: 10 * time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 5, StartTime: at(-4), EndTime: at(-2)},
+						{ID: 1, StartTime: at(-20), EndTime: at(-12)},
+						{ID: 2, StartTime: at(-9), EndTime: at(-8)},
+						{ID: 3, StartTime: at(-8), EndTime: at(-7)},
+						{ID: 4, StartTime: at(-7), EndTime: at(-6), DeletedAt: at(-1)},
+					},
+				}},
+			}}
+		},
+	}
+
+	gaps, err := s.CoverageGaps("db0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 2 {
+		t.Fatalf("unexpected gaps: %+v", gaps)
+	} else if g := gaps[0]; !g.End.Equal(at(-9)) || g.Start.Before(at(-10)) || !g.Start.Before(at(-9)) {
+		t.Fatalf("unexpected gap clipped to the retention window: %+v", g)
+	} else if g := gaps[1]; !g.Start.Equal(at(-7)) || !g.End.Equal(at(-4)) {
+		t.Fatalf("unexpected gap: %+v", g)
+	}
+
+	if _, err := s.CoverageGaps("db1", "rp0"); err != meta.ErrDatabaseNotExists {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := s.CoverageGaps("db0", "rp1"); err != meta.ErrRetentionPolicyNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure protected shard groups are not deleted when they expire.
+func TestService_ProtectShardGroups(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	var mu sync.Mutex
+	var deleted []uint64
+	done := make(chan struct{})
+
+	s := retention.NewService(c)
+	s.ProtectShardGroups(1, 2, 4)
+	s.UnprotectShardGroups(4)
+	if ids := s.ProtectedShardGroups(); !reflect.DeepEqual(ids, []uint64{1, 2}) {
+		t.Fatalf("unexpected protected shard groups: %v", ids)
+	}
+
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(10, 0)},
+						{ID: 2, EndTime: time.Unix(20, 0)},
+						{ID: 3, EndTime: time.Unix(30, 0)},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if deleted = append(deleted, id); len(deleted) == 1 {
+				close(done)
+			}
+			return nil
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard group deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range deleted {
+		if id != 3 {
+			t.Fatalf("unexpected shard group deleted: %d", id)
+		}
+	}
+}
+
+// Ensure the most recent shard groups are kept even when they have expired.
+func TestService_MinKeepShardGroups(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.MinKeepShardGroups = 2
+
+	var mu sync.Mutex
+	var deleted []uint64
+	done := make(chan struct{})
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(10, 0)},
+						{ID: 2, EndTime: time.Unix(30, 0)},
+						{ID: 3, EndTime: time.Unix(20, 0)},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if deleted = append(deleted, id); len(deleted) == 1 {
+				close(done)
+			}
+			return nil
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard group deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range deleted {
+		if id != 1 {
+			t.Fatalf("unexpected shard group deleted: %d", id)
+		}
+	}
+}
+
+// Ensure expired shard groups are deleted in the configured order.
+func TestService_ShardGroupDeletionOrder(t *testing.T) {
+	for _, tt := range []struct {
+		order retention.DeletionOrder
+		exp   []uint64
+	}{
+		{order: retention.DeletionOrderOldestFirst, exp: []uint64{2, 3, 1}},
+		{order: retention.DeletionOrderNewestFirst, exp: []uint64{1, 3, 2}},
+	} {
+		c := retention.NewConfig()
+		c.CheckInterval = toml.Duration(10 * time.Millisecond)
+		c.ShardGroupDeletionOrder = tt.order
+
+		var mu sync.Mutex
+		var deleted []uint64
+		done := make(chan struct{})
+
+		s := retention.NewService(c)
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{
+					{
+						Name: "db0",
+						RetentionPolicies: []meta.RetentionPolicyInfo{{
+							Name:        "rp0",
+							Duration:    time.Hour,
+							ShardGroups: []meta.ShardGroupInfo{{ID: 1, StartTime: time.Unix(30, 0), EndTime: time.Unix(40, 0)}},
+						}},
+					},
+					{
+						Name: "db1",
+						RetentionPolicies: []meta.RetentionPolicyInfo{{
+							Name:     "rp0",
+							Duration: time.Hour,
+							ShardGroups: []meta.ShardGroupInfo{
+								{ID: 2, StartTime: time.Unix(10, 0), EndTime: time.Unix(20, 0)},
+								{ID: 3, StartTime: time.Unix(20, 0), EndTime: time.Unix(30, 0)},
+							},
+						}},
+					},
+				}
+			},
+			DeleteShardGroupFn: func(database, policy string, id uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if deleted = append(deleted, id); len(deleted) == 3 {
+					close(done)
+				}
+				return nil
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		s.TSDBStore = &TSDBStore{
+			ShardIDsFn: func() []uint64 { return nil },
+		}
+
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for shard group deletion")
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		if !reflect.DeepEqual(deleted[:3], tt.exp) {
+			t.Fatalf("%s: unexpected deletion order: %v", tt.order, deleted)
+		}
+		mu.Unlock()
+	}
+}
+
+// Ensure enforcement doesn't start until the startup delay has passed.
+func TestService_StartupDelay(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.StartupDelay = toml.Duration(time.Hour)
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			t.Error("unexpected enforcement during startup delay")
+			return nil
+		},
+	}
+	s.TSDBStore = &TSDBStore{}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the service refuses to open without its dependencies.
+func TestService_Open_MissingDependency(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.TSDBStore = &TSDBStore{}
+	if err := s.Open(); err != retention.ErrNoMetaClient {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s = retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{}
+	if err := s.Open(); err != retention.ErrNoTSDBStore {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := s.GoroutineCount(); n != 0 {
+		t.Fatalf("unexpected goroutine count: %d", n)
+	}
+}
+
+// Ensure the service reports its running goroutines.
+func TestService_GoroutineCount(t *testing.T) {
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{}
+	s.TSDBStore = &TSDBStore{}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; s.GoroutineCount() != 2; i++ {
+		if i == 100 {
+			t.Fatalf("unexpected goroutine count: %d", s.GoroutineCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := s.Statistics(nil)[0].Values["goroutines"]; v != int64(2) {
+		t.Fatalf("unexpected goroutines statistic: %v", v)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := s.GoroutineCount(); n != 0 {
+		t.Fatalf("unexpected goroutine count after close: %d", n)
+	}
+}
+
+// Ensure the watchdog reports when no enforcement pass completes.
+func TestService_Watchdog(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	stalled := make(chan time.Time, 1)
+	s := retention.NewService(c)
+	s.MaxSilence = 20 * time.Millisecond
+	s.OnStall = func(lastRun time.Time) {
+		select {
+		case stalled <- lastRun:
+		default:
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn:        func() []meta.DatabaseInfo { return nil },
+		PruneShardGroupsFn: func() error { return errors.New("meta unavailable") },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	opened := time.Now()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lastRun := <-stalled:
+		if lastRun.Before(opened) {
+			t.Fatalf("unexpected last run: %s", lastRun)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stall")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure every deleted shard is recorded in the audit log.
+func TestService_AuditWriter(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	deleted := make(chan struct{})
+	s := retention.NewService(c)
+	s.AuditWriter = &buf
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 {
+			select {
+			case <-deleted:
+				return nil
+			default:
+				return []uint64{5}
+			}
+		},
+		DeleteShardFn: func(shardID uint64) error {
+			close(deleted)
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec struct {
+		Type            string `json:"type"`
+		Database        string `json:"database"`
+		RetentionPolicy string `json:"retention_policy"`
+		ID              uint64 `json:"id"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("unexpected audit log %q: %s", buf.String(), err)
+	} else if rec.Type != "shard" || rec.Database != "db0" || rec.RetentionPolicy != "rp0" || rec.ID != 5 {
+		t.Fatalf("unexpected audit record: %+v", rec)
+	}
+}
+
+// Ensure shards which are already gone are not recorded as deleted.
+func TestService_ShardAlreadyDeleted(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	attempted := make(chan struct{}, 1)
+	errShardNotFound := errors.New("shard not found")
+	s := retention.NewService(c)
+	s.AuditWriter = &buf
+	s.ShardNotFoundError = errShardNotFound
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5} },
+		DeleteShardFn: func(shardID uint64) error {
+			select {
+			case attempted <- struct{}{}:
+			default:
+			}
+			return errShardNotFound
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected audit log: %s", buf.String())
+	} else if n := s.Report()[0].ShardsDeleted; n != 0 {
+		t.Fatalf("unexpected deleted shard count: %d", n)
+	} else if v := s.Statistics(nil)[0].Values["deletionBacklog"]; v != int64(0) {
+		t.Fatalf("unexpected deletion backlog: %v", v)
+	}
+
+	// Without a not-found error configured, the error is a failure.
+	s.ShardNotFoundError = nil
+	if err := s.EnforceContext(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if v := s.Statistics(nil)[0].Values["deletionBacklog"]; v != int64(1) {
+		t.Fatalf("unexpected deletion backlog: %v", v)
+	}
+}
+
+// Ensure shards are not deleted when the approver vetoes them.
+func TestService_DeleteShardApprover(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	approved := make(chan uint64, 1)
+	s := retention.NewService(c)
+	s.DeleteShardApprover = func(db, rp string, shardID uint64) bool {
+		if db != "db0" || rp != "rp0" {
+			t.Errorf("unexpected database and retention policy: %s.%s", db, rp)
+		}
+		select {
+		case approved <- shardID:
+		default:
+		}
+		return false
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5} },
+		DeleteShardFn: func(shardID uint64) error {
+			t.Errorf("unexpected deletion of shard %d", shardID)
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-approved:
+		if id != 5 {
+			t.Fatalf("unexpected shard ID: %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for approval")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure progress is reported as each shard of a pass is handled.
+func TestService_ProgressFunc(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	progress := make(chan [2]int, 2)
+	s := retention.NewService(c)
+	s.ProgressFunc = func(done, total int) {
+		select {
+		case progress <- [2]int{done, total}:
+		default:
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn:    func() []uint64 { return []uint64{5, 6} },
+		DeleteShardFn: func(shardID uint64) error { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, exp := range [][2]int{{1, 2}, {2, 2}} {
+		select {
+		case p := <-progress:
+			if p != exp {
+				t.Fatalf("unexpected progress: exp %v, got %v", exp, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for progress")
+		}
+	}
+}
+
+// Ensure the bytes freed by shard deletions are reported per policy.
+func TestService_Statistics_BytesFreed(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	var once sync.Once
+	s := retention.NewService(c)
+	s.ProgressFunc = func(n, total int) {
+		if n == total {
+			once.Do(func() { close(done) })
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+
+	var mu sync.Mutex
+	deleted := make(map[uint64]bool)
+	s.TSDBStore = &SizedTSDBStore{
+		TSDBStore: TSDBStore{
+			ShardIDsFn: func() []uint64 {
+				mu.Lock()
+				defer mu.Unlock()
+				var ids []uint64
+				for _, id := range []uint64{5, 6} {
+					if !deleted[id] {
+						ids = append(ids, id)
+					}
+				}
+				return ids
+			},
+			DeleteShardFn: func(shardID uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted[shardID] = true
+				return nil
+			},
+		},
+		ShardSizeFn: func(shardID uint64) (int64, error) { return int64(shardID) * 100, nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.Statistics(map[string]string{"hostname": "server01"})
+	if len(stats) != 2 {
+		t.Fatalf("unexpected statistics: %v", stats)
+	}
+	exp := models.Statistic{
+		Name: "retention",
+		Tags: map[string]string{"database": "db0", "retention_policy": "rp0", "hostname": "server01"},
+		Values: map[string]interface{}{
+			"shardGroupsDeleted": int64(0),
+			"shardsDeleted":      int64(2),
+			"bytesFreed":         int64(1100),
+		},
+	}
+	if !reflect.DeepEqual(stats[1], exp) {
+		t.Fatalf("unexpected statistic:\n\ngot=%+v\n\nexp=%+v", stats[1], exp)
+	}
+}
+
+// Ensure the shards that could not be deleted in the last pass are reported,
+// along with an estimate of how long they will take to delete.
+func TestService_Statistics_DeletionBacklog(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	var once sync.Once
+	s := retention.NewService(c)
+	s.ProgressFunc = func(n, total int) {
+		if n == total {
+			once.Do(func() { close(done) })
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}, {ID: 7}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5, 6, 7} },
+		DeleteShardFn: func(shardID uint64) error {
+			if shardID == 6 {
+				return nil
+			}
+			return errors.New("boom")
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := s.Statistics(nil)[0].Values["deletionBacklog"]; v != int64(2) {
+		t.Fatalf("unexpected deletion backlog: %v", v)
+	} else if eta := s.DeletionETA(); eta <= 0 {
+		t.Fatalf("unexpected deletion ETA: %s", eta)
+	} else if v := s.Statistics(nil)[0].Values["deletionETA"]; v != int64(eta) {
+		t.Fatalf("unexpected deletion ETA statistic: %v", v)
+	}
+}
+
+// Ensure shards that a fresh meta lookup finds in a live shard group are kept.
+func TestService_ShardOwned(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	var once sync.Once
+	s := retention.NewService(c)
+	s.ProgressFunc = func(n, total int) {
+		if n == total {
+			once.Do(func() { close(done) })
+		}
+	}
+	s.MetaClient = &OwnerMetaClient{
+		MetaClient: MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{{
+							ID:        1,
+							DeletedAt: time.Unix(0, 0),
+							Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+						}},
+					}},
+				}}
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		},
+		ShardOwnerFn: func(shardID uint64) (string, string, *meta.ShardGroupInfo) {
+			if shardID == 5 {
+				return "db0", "rp0", &meta.ShardGroupInfo{ID: 2}
+			}
+			return "", "", nil
+		},
+	}
+
+	var mu sync.Mutex
+	var deleted []uint64
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5, 6} },
+		DeleteShardFn: func(shardID uint64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = append(deleted, shardID)
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for deletion")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range deleted {
+		if id != 6 {
+			t.Fatalf("unexpected deletion of shard %d", id)
+		}
+	}
+	if len(deleted) == 0 {
+		t.Fatal("expected shard 6 to be deleted")
+	}
+}
+
+// Ensure a slow shard deletion does not block the rest of the pass and is not
+// reissued until it finishes.
+func TestService_ShardDeleteTimeout(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.ShardDeleteTimeout = toml.Duration(10 * time.Millisecond)
+
+	var passes int32
+	s := retention.NewService(c)
+	s.ProgressFunc = func(n, total int) {
+		if n == total {
+			atomic.AddInt32(&passes, 1)
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+
+	release := make(chan struct{})
+	var slow, fast int32
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5, 6} },
+		DeleteShardFn: func(shardID uint64) error {
+			if shardID == 5 {
+				if atomic.AddInt32(&slow, 1) == 1 {
+					<-release
+				}
+				return nil
+			}
+			atomic.AddInt32(&fast, 1)
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Wait for several passes while shard 5 is still being deleted.
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&passes) < 3 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for retention passes")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if n := atomic.LoadInt32(&fast); n == 0 {
+		t.Fatal("expected shard 6 to be deleted")
+	}
+	if n := atomic.LoadInt32(&slow); n != 1 {
+		t.Fatalf("shard 5 deleted %d times while deletion was running, expected 1", n)
+	}
+
+	// Once the slow deletion finishes, the shard is retried.
+	close(release)
+	for atomic.LoadInt32(&slow) < 2 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for shard 5 to be retried")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// Ensure Close waits for a shard deletion that timed out to finish.
+func TestService_ShardDeleteTimeout_Close(t *testing.T) {
+	c := retention.NewConfig()
+	c.ShardDeleteTimeout = toml.Duration(10 * time.Millisecond)
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	release := make(chan struct{})
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5} },
+		DeleteShardFn: func(shardID uint64) error {
+			<-release
+			return nil
+		},
+	}
+
+	if err := s.EnforceContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("service closed while a shard deletion was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the service to close")
+	}
+}
+
+// Ensure a shard that keeps failing to be deleted is given up on and reported.
+func TestService_FailedDeletions(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.MaxShardDeleteFailures = 2
+
+	var passes int32
+	s := retention.NewService(c)
+	s.ProgressFunc = func(n, total int) {
+		if n == total {
+			atomic.AddInt32(&passes, 1)
+		}
+	}
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+
+	var attempts int32
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5, 6} },
+		DeleteShardFn: func(shardID uint64) error {
+			if shardID == 5 {
+				atomic.AddInt32(&attempts, 1)
+				return errors.New("disk on fire")
+			}
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&passes) < 4 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for retention passes")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("unexpected deletion attempts: %d", n)
+	}
+	exp := []retention.FailedShard{{ID: 5, Database: "db0", RetentionPolicy: "rp0", Failures: 2, LastError: "disk on fire"}}
+	if a := s.FailedDeletions(); !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected failed deletions: %+v", a)
+	}
+}
+
+// Ensure deletions go through the deleter when one is set.
+func TestService_Deleter(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(0, 0)},
+						{ID: 2, EndTime: time.Unix(0, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 5}}},
+					},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5} },
+	}
+
+	groups := make(chan uint64, 10)
+	shards := make(chan uint64, 10)
+	s.Deleter = &ShardDeleter{
+		DeleteShardFn: func(shardID uint64) error {
+			select {
+			case shards <- shardID:
+			default:
+			}
+			return nil
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			select {
+			case groups <- id:
+			default:
+			}
+			return nil
+		},
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case id := <-groups:
+		if id != 1 {
+			t.Fatalf("unexpected shard group deleted: %d", id)
+		}
+	case <-timeout:
+		t.Fatal("timed out waiting for shard group deletion")
+	}
+	select {
+	case id := <-shards:
+		if id != 5 {
+			t.Fatalf("unexpected shard deleted: %d", id)
+		}
+	case <-timeout:
+		t.Fatal("timed out waiting for shard deletion")
+	}
+}
+
+// Ensure deletions and errors are sent on the events channel without blocking.
+func TestService_Events(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.EventBufferSize = 1
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(0, 0)},
+						{ID: 2, EndTime: time.Unix(0, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 5}}},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error { return nil },
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn:    func() []uint64 { return []uint64{5} },
+		DeleteShardFn: func(shardID uint64) error { return errors.New("disk on fire") },
+	}
+
+	events := s.Events()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[retention.EventType]retention.RetentionEvent)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case e := <-events:
+			seen[e.Type] = e
+		case <-timeout:
+			t.Fatalf("timed out waiting for events: %v", seen)
+		}
+	}
+	if e := seen[retention.EventShardGroupDeleted]; e.ID != 1 || e.Database != "db0" || e.RetentionPolicy != "rp0" {
+		t.Fatalf("unexpected shard group event: %+v", e)
+	} else if e := seen[retention.EventError]; e.ID != 5 || e.Err == nil || e.Err.Error() != "disk on fire" {
+		t.Fatalf("unexpected error event: %+v", e)
+	}
+
+	// Events are dropped, rather than blocking enforcement, once the channel is full.
+	dropped := func() int64 {
+		return s.Statistics(nil)[0].Values["eventsDropped"].(int64)
+	}
+	for dropped() == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for events to be dropped")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+}
+
+// Ensure a manual pass stops between shards once its context is cancelled.
+func TestService_EnforceContext(t *testing.T) {
+	var groups, shards []uint64
+	var pruned bool
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(0, 0)},
+						{ID: 2, EndTime: time.Unix(0, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 5}, {ID: 6}, {ID: 7}}},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			groups = append(groups, id)
+			return nil
+		},
+		PruneShardGroupsFn: func() error {
+			pruned = true
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return []uint64{5, 6, 7} },
+		DeleteShardFn: func(shardID uint64) error {
+			shards = append(shards, shardID)
+			cancel()
+			return nil
+		},
+	}
+
+	if err := s.EnforceContext(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !reflect.DeepEqual(groups, []uint64{1}) {
+		t.Fatalf("unexpected shard groups deleted: %v", groups)
+	} else if !reflect.DeepEqual(shards, []uint64{5}) {
+		t.Fatalf("unexpected shards deleted: %v", shards)
+	} else if pruned {
+		t.Fatal("unexpected pruning of a cancelled pass")
+	}
+
+	// A cancelled context stops the pass before anything is deleted.
+	groups, shards = nil, nil
+	if err := s.EnforceContext(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(groups) != 0 || len(shards) != 0 {
+		t.Fatalf("unexpected deletions: %v, %v", groups, shards)
+	}
+
+	if err := s.EnforceContext(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(shards, []uint64{5, 6, 7}) || !pruned {
+		t.Fatalf("unexpected pass: %v (pruned=%v)", shards, pruned)
+	}
+}
+
+// Ensure a pass started while another of the same kind is running returns
+// ErrPassInProgress without touching the store.
+func TestService_EnforceContext_PassInProgress(t *testing.T) {
+	var groupCalls, shardIDsCalls, shardCalls int64
+	blockGroup := make(chan struct{})
+	blockShard := make(chan struct{})
+	groupStarted := make(chan struct{})
+	shardStarted := make(chan struct{})
+
+	s := retention.NewService(retention.NewConfig())
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:     "rp0",
+					Duration: time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{
+						{ID: 1, EndTime: time.Unix(0, 0)},
+						{ID: 2, EndTime: time.Unix(0, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 5}}},
+					},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			if atomic.AddInt64(&groupCalls, 1) == 1 {
+				close(groupStarted)
+				<-blockGroup
+			}
+			return nil
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 {
+			atomic.AddInt64(&shardIDsCalls, 1)
+			return []uint64{5}
+		},
+		DeleteShardFn: func(shardID uint64) error {
+			if atomic.AddInt64(&shardCalls, 1) == 1 {
+				close(shardStarted)
+				<-blockShard
+			}
+			return nil
+		},
+	}
+
+	errC := make(chan error, 1)
+	go func() { errC <- s.EnforceContext(context.Background()) }()
+
+	// A second pass while shard groups are being deleted.
+	<-groupStarted
+	if err := s.EnforceContext(context.Background()); err != retention.ErrPassInProgress {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := atomic.LoadInt64(&groupCalls); n != 1 {
+		t.Fatalf("unexpected shard group deletions: %d", n)
+	} else if n := atomic.LoadInt64(&shardIDsCalls); n != 0 {
+		t.Fatalf("unexpected shard listings: %d", n)
+	}
+	close(blockGroup)
+
+	// A second pass while shards are being deleted. The shard group pass
+	// is free again, so only the shard pass is refused.
+	<-shardStarted
+	if err := s.EnforceContext(context.Background()); err != retention.ErrPassInProgress {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := atomic.LoadInt64(&shardIDsCalls); n != 1 {
+		t.Fatalf("unexpected shard listings: %d", n)
+	} else if n := atomic.LoadInt64(&shardCalls); n != 1 {
+		t.Fatalf("unexpected shard deletions: %d", n)
+	}
+	close(blockShard)
+
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+
+	// Passes can run again once the first one is done.
+	if err := s.EnforceContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure expired shard groups are deleted with bounded concurrency.
+func TestService_ShardGroupDeleteConcurrency(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.ShardGroupDeleteConcurrency = 3
+
+	var groups []meta.ShardGroupInfo
+	for i := 1; i <= 9; i++ {
+		groups = append(groups, meta.ShardGroupInfo{ID: uint64(i), EndTime: time.Unix(0, 0)})
+	}
+
+	var mu sync.Mutex
+	var active, max int
+	deleted := make(map[uint64]bool)
+	done := make(chan struct{})
+
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			mu.Lock()
+			defer mu.Unlock()
+			var remaining []meta.ShardGroupInfo
+			for _, g := range groups {
+				if !deleted[g.ID] {
+					remaining = append(remaining, g)
+				}
+			}
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{
+					{Name: "rp0", Duration: time.Hour, ShardGroups: remaining},
+				},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			mu.Lock()
+			if active++; active > max {
+				max = active
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			active--
+			deleted[id] = true
+			if len(deleted) == len(groups) {
+				close(done)
+			}
+			return nil
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard groups to be deleted")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if max > c.ShardGroupDeleteConcurrency {
+		t.Fatalf("too many concurrent deletions: %d", max)
+	}
+}
+
+// Ensure shard group deletion is deferred while the disk is critically full
+// but shards are still deleted.
+func TestService_DiskFull(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.MinDiskFree = 10
+
+	pruned := make(chan struct{}, 1)
+	s := retention.NewService(c)
+	s.DiskUsage = func() (uint64, uint64) { return 1, 100 }
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name:        "rp0",
+					Duration:    time.Hour,
+					ShardGroups: []meta.ShardGroupInfo{{ID: 1, EndTime: time.Unix(0, 0)}},
+				}},
+			}}
+		},
+		DeleteShardGroupFn: func(database, policy string, id uint64) error {
+			t.Error("unexpected shard group deletion")
+			return nil
+		},
+		PruneShardGroupsFn: func() error {
+			select {
+			case pruned <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pruned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shard deletion check")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the disk state and deferred passes are reported in the statistics.
+func TestService_DiskFull_Statistics(t *testing.T) {
+	for _, tt := range []struct {
+		minFree     uint64
+		free, total uint64
+		deferred    int64
+	}{
+		{minFree: 10, free: 1, total: 100, deferred: 1},
+		{minFree: 10, free: 50, total: 100, deferred: 0},
+		{minFree: 0, free: 1, total: 100, deferred: 0},
+
+		// Unknown usage is neither reported nor gates deletion.
+		{minFree: 10, free: 0, total: 0, deferred: 0},
+	} {
+		c := retention.NewConfig()
+		c.MinDiskFree = tt.minFree
+
+		var groups int
+		s := retention.NewService(c)
+		s.DiskUsage = func() (uint64, uint64) { return tt.free, tt.total }
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name:        "rp0",
+						Duration:    time.Hour,
+						ShardGroups: []meta.ShardGroupInfo{{ID: 1, EndTime: time.Unix(0, 0)}},
+					}},
+				}}
+			},
+			DeleteShardGroupFn: func(database, policy string, id uint64) error {
+				groups++
+				return nil
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		s.TSDBStore = &TSDBStore{
+			ShardIDsFn: func() []uint64 { return nil },
+		}
+
+		if err := s.EnforceContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		values := s.Statistics(nil)[0].Values
+		if v := values["diskFree"]; v != int64(tt.free) {
+			t.Fatalf("unexpected disk free: %v", v)
+		} else if v := values["diskTotal"]; v != int64(tt.total) {
+			t.Fatalf("unexpected disk total: %v", v)
+		} else if v := values["passesDeferred"]; v != tt.deferred {
+			t.Fatalf("unexpected deferred passes: %v", v)
+		} else if exp := 1 - int(tt.deferred); groups != exp {
+			t.Fatalf("unexpected shard groups deleted: %d, expected %d", groups, exp)
+		}
+	}
+}
+
+// Ensure failed meta client calls are retried before being reported.
+func TestService_MetaRetries(t *testing.T) {
+	c := retention.NewConfig()
+	c.CheckInterval = toml.Duration(10 * time.Millisecond)
+	c.MetaRetries = 2
+	c.MetaRetryDelay = toml.Duration(time.Millisecond)
+
+	// Without retries, the first failure would pause enforcement.
+	c.MetaFailureThreshold = 1
+	c.MetaFailureCooldown = toml.Duration(time.Hour)
+
+	var calls int64
+	pruned := make(chan struct{})
+	s := retention.NewService(c)
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo { return nil },
+		PruneShardGroupsFn: func() error {
+			switch atomic.AddInt64(&calls, 1) {
+			case 1, 2:
+				return errors.New("meta unavailable")
+			case 3:
+				close(pruned)
+			}
+			return nil
+		},
+	}
+	s.TSDBStore = &TSDBStore{
+		ShardIDsFn: func() []uint64 { return nil },
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	select {
+	case <-pruned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for prune retry")
+	}
+}
+
+// Ensure shards excluded by the filter are not deleted, and that every shard
+// is deleted without a filter.
+func TestService_ShardFilter(t *testing.T) {
+	for _, tt := range []struct {
+		filter func(id uint64) bool
+		exp    []uint64
+	}{
+		{filter: nil, exp: []uint64{5, 6, 7}},
+		{filter: func(id uint64) bool { return id != 6 }, exp: []uint64{5, 7}},
+	} {
+		var deleted []uint64
+		s := retention.NewService(retention.NewConfig())
+		s.ShardFilter = tt.filter
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{{
+							ID:        1,
+							DeletedAt: time.Unix(0, 0),
+							Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}, {ID: 7}},
+						}},
+					}},
+				}}
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		s.TSDBStore = &TSDBStore{
+			ShardIDsFn: func() []uint64 { return []uint64{5, 6, 7} },
+			DeleteShardFn: func(shardID uint64) error {
+				deleted = append(deleted, shardID)
+				return nil
+			},
+		}
+
+		if err := s.EnforceContext(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(deleted, tt.exp) {
+			t.Fatalf("unexpected shards deleted: %v, expected %v", deleted, tt.exp)
+		}
+	}
+}
+
+// Ensure the time taken by each step of a pass is only logged when verbose.
+func TestService_Verbose(t *testing.T) {
+	for _, verbose := range []bool{false, true} {
+		c := retention.NewConfig()
+		c.Verbose = verbose
+
+		var buf bytes.Buffer
+		s := retention.NewService(c)
+		s.WithLogger(zap.New(
+			zap.NewTextEncoder(),
+			zap.DebugLevel,
+			zap.Output(zap.AddSync(&buf)),
+		))
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{{
+							ID:        1,
+							DeletedAt: time.Unix(0, 0),
+							Shards:    []meta.ShardInfo{{ID: 5}},
+						}},
+					}},
+				}}
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		s.TSDBStore = &TSDBStore{
+			ShardIDsFn:    func() []uint64 { return []uint64{5} },
+			DeleteShardFn: func(shardID uint64) error { return nil },
+		}
+
+		if err := s.EnforceContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []string{"shard meta lookup", "deletion of 1 shards", "shard group pruning"} {
+			if logged := strings.Contains(buf.String(), "retention "+step+" took"); logged != verbose {
+				t.Fatalf("unexpected timing of %q logged=%v with verbose=%v:\n%s", step, logged, verbose, buf.String())
+			}
+		}
+	}
+}
+
+// Ensure shards are compacted immediately before deletion when configured,
+// and never otherwise.
+func TestService_CompactBeforeDelete(t *testing.T) {
+	for _, tt := range []struct {
+		compact bool
+		exp     []string
+	}{
+		{compact: false, exp: []string{"delete 5", "delete 6"}},
+		{compact: true, exp: []string{"compact 5", "delete 5", "compact 6", "delete 6"}},
+	} {
+		c := retention.NewConfig()
+		c.CompactBeforeDelete = tt.compact
+
+		var calls []string
+		s := retention.NewService(c)
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{{
+							ID:        1,
+							DeletedAt: time.Unix(0, 0),
+							Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+						}},
+					}},
+				}}
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		s.TSDBStore = &CompactingTSDBStore{
+			TSDBStore: TSDBStore{
+				ShardIDsFn: func() []uint64 { return []uint64{5, 6} },
+				DeleteShardFn: func(shardID uint64) error {
+					calls = append(calls, fmt.Sprintf("delete %d", shardID))
+					return nil
+				},
+			},
+			CompactShardFn: func(shardID uint64) error {
+				calls = append(calls, fmt.Sprintf("compact %d", shardID))
+				// A failed compaction doesn't prevent the deletion.
+				if shardID == 6 {
+					return errors.New("compaction failed")
+				}
+				return nil
+			},
+		}
+
+		if err := s.EnforceContext(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(calls, tt.exp) {
+			t.Fatalf("unexpected calls with compaction=%v: %v", tt.compact, calls)
+		}
+	}
+}
+
+// Ensure shards are deleted in the configured order.
+func TestService_DeletionOrder(t *testing.T) {
+	for _, tt := range []struct {
+		order retention.DeletionOrder
+		sized bool
+		exp   []uint64
+	}{
+		{order: retention.DeletionOrderDefault, sized: true, exp: []uint64{7, 5, 6}},
+		{order: retention.DeletionOrderOldestFirst, sized: true, exp: []uint64{7, 6, 5}},
+		{order: retention.DeletionOrderLargestFirst, sized: true, exp: []uint64{6, 5, 7}},
+
+		// Without shard sizes, largest-first falls back to the store's order.
+		{order: retention.DeletionOrderLargestFirst, sized: false, exp: []uint64{7, 5, 6}},
+	} {
+		c := retention.NewConfig()
+		c.DeletionOrder = tt.order
+
+		var deleted []uint64
+		s := retention.NewService(c)
+		s.MetaClient = &MetaClient{
+			DatabasesFn: func() []meta.DatabaseInfo {
+				return []meta.DatabaseInfo{{
+					Name: "db0",
+					RetentionPolicies: []meta.RetentionPolicyInfo{{
+						Name: "rp0",
+						ShardGroups: []meta.ShardGroupInfo{
+							{ID: 1, StartTime: time.Unix(20, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 5}}},
+							{ID: 2, StartTime: time.Unix(10, 0), DeletedAt: time.Unix(0, 0), Shards: []meta.ShardInfo{{ID: 6}, {ID: 7}}},
+						},
+					}},
+				}}
+			},
+			PruneShardGroupsFn: func() error { return nil },
+		}
+		store := TSDBStore{
+			ShardIDsFn: func() []uint64 { return []uint64{7, 5, 6} },
+			DeleteShardFn: func(shardID uint64) error {
+				deleted = append(deleted, shardID)
+				return nil
+			},
+		}
+		if tt.sized {
+			s.TSDBStore = &SizedTSDBStore{
+				TSDBStore: store,
+				ShardSizeFn: func(shardID uint64) (int64, error) {
+					// Shards of unknown size are deleted last.
+					switch shardID {
+					case 5:
+						return 100, nil
+					case 6:
+						return 300, nil
+					}
+					return 0, errors.New("unknown size")
+				},
+			}
+		} else {
+			s.TSDBStore = &store
+		}
+
+		if err := s.EnforceContext(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(deleted, tt.exp) {
+			t.Fatalf("unexpected deletion order for %q (sized=%v): %v, expected %v", tt.order, tt.sized, deleted, tt.exp)
+		}
+	}
+}
+
+// Ensure a shard the store still reports after deleting it is counted as a
+// failed deletion and not audited.
+func TestService_ShardStillExists(t *testing.T) {
+	c := retention.NewConfig()
+	c.MaxShardDeleteFailures = 1
+
+	var buf bytes.Buffer
+	var deleted []uint64
+	s := retention.NewService(c)
+	s.AuditWriter = &buf
+	s.MetaClient = &MetaClient{
+		DatabasesFn: func() []meta.DatabaseInfo {
+			return []meta.DatabaseInfo{{
+				Name: "db0",
+				RetentionPolicies: []meta.RetentionPolicyInfo{{
+					Name: "rp0",
+					ShardGroups: []meta.ShardGroupInfo{{
+						ID:        1,
+						DeletedAt: time.Unix(0, 0),
+						Shards:    []meta.ShardInfo{{ID: 5}, {ID: 6}},
+					}},
+				}},
+			}}
+		},
+		PruneShardGroupsFn: func() error { return nil },
+	}
+	s.TSDBStore = &CheckingTSDBStore{
+		TSDBStore: TSDBStore{
+			ShardIDsFn: func() []uint64 { return []uint64{5, 6} },
+			DeleteShardFn: func(shardID uint64) error {
+				deleted = append(deleted, shardID)
+				return nil
+			},
+		},
+		ShardExistsFn: func(shardID uint64) bool { return shardID == 5 },
+	}
+
+	if err := s.EnforceContext(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(deleted, []uint64{5, 6}) {
+		t.Fatalf("unexpected deletions: %v", deleted)
+	}
+
+	exp := []retention.FailedShard{{ID: 5, Database: "db0", RetentionPolicy: "rp0", Failures: 1, LastError: "shard still exists after deletion"}}
+	if a := s.FailedDeletions(); !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected failed deletions: %+v", a)
+	} else if v := s.Statistics(nil)[0].Values["deletionBacklog"]; v != int64(1) {
+		t.Fatalf("unexpected deletion backlog: %v", v)
+	} else if n := s.Report()[0].ShardsDeleted; n != 1 {
+		t.Fatalf("unexpected deleted shard count: %d", n)
+	}
+
+	// Only the shard that is really gone is audited.
+	var rec struct {
+		ID uint64 `json:"id"`
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 {
+		t.Fatalf("unexpected audit log: %s", buf.String())
+	} else if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	} else if rec.ID != 6 {
+		t.Fatalf("unexpected audited shard: %d", rec.ID)
+	}
+}
+
+// MetaClient is a mock implementation of the retention service's meta client.
+type MetaClient struct {
+	DatabasesFn        func() []meta.DatabaseInfo
+	DeleteShardGroupFn func(database, policy string, id uint64) error
+	PruneShardGroupsFn func() error
+}
+
+func (c *MetaClient) Databases() []meta.DatabaseInfo {
+	return c.DatabasesFn()
+}
+
+func (c *MetaClient) DeleteShardGroup(database, policy string, id uint64) error {
+	return c.DeleteShardGroupFn(database, policy, id)
+}
+
+func (c *MetaClient) PruneShardGroups() error {
+	return c.PruneShardGroupsFn()
+}
+
+// TSDBStore is a mock implementation of the retention service's store.
+type TSDBStore struct {
+	ShardIDsFn    func() []uint64
+	DeleteShardFn func(shardID uint64) error
+}
+
+func (s *TSDBStore) ShardIDs() []uint64 {
+	return s.ShardIDsFn()
+}
+
+func (s *TSDBStore) DeleteShard(shardID uint64) error {
+	return s.DeleteShardFn(shardID)
+}
+
+// ShardDeleter is a mock implementation of retention.ShardDeleter.
+type ShardDeleter struct {
+	DeleteShardFn      func(shardID uint64) error
+	DeleteShardGroupFn func(database, policy string, id uint64) error
+}
+
+func (d *ShardDeleter) DeleteShard(shardID uint64) error {
+	return d.DeleteShardFn(shardID)
+}
+
+func (d *ShardDeleter) DeleteShardGroup(database, policy string, id uint64) error {
+	return d.DeleteShardGroupFn(database, policy, id)
+}
+
+// OwnerMetaClient is a MetaClient that can look up the owner of a shard.
+type OwnerMetaClient struct {
+	MetaClient
+	ShardOwnerFn func(shardID uint64) (database, policy string, sgi *meta.ShardGroupInfo)
+}
+
+func (c *OwnerMetaClient) ShardOwner(shardID uint64) (database, policy string, sgi *meta.ShardGroupInfo) {
+	return c.ShardOwnerFn(shardID)
+}
+
+// SizedTSDBStore is a TSDBStore that reports shard sizes.
+type SizedTSDBStore struct {
+	TSDBStore
+	ShardSizeFn func(shardID uint64) (int64, error)
+}
+
+func (s *SizedTSDBStore) ShardSize(shardID uint64) (int64, error) {
+	return s.ShardSizeFn(shardID)
+}
+
+// CompactingTSDBStore is a TSDBStore that can compact shards.
+type CompactingTSDBStore struct {
+	TSDBStore
+	CompactShardFn func(shardID uint64) error
+}
+
+func (s *CompactingTSDBStore) CompactShard(shardID uint64) error {
+	return s.CompactShardFn(shardID)
+}
+
+// CheckingTSDBStore is a TSDBStore that reports whether shards still exist.
+type CheckingTSDBStore struct {
+	TSDBStore
+	ShardExistsFn func(shardID uint64) bool
+}
+
+func (s *CheckingTSDBStore) ShardExists(shardID uint64) bool {
+	return s.ShardExistsFn(shardID)
+}
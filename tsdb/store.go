@@ -353,11 +353,40 @@ func (s *Store) SetShardEnabled(shardID uint64, enabled bool) error {
 	return nil
 }
 
-// DeleteShard removes a shard from disk.
+// ShardSize returns the size on disk of the shard with the given id.
+func (s *Store) ShardSize(id uint64) (int64, error) {
+	sh := s.Shard(id)
+	if sh == nil {
+		return 0, ErrShardNotFound
+	}
+	return sh.DiskSize()
+}
+
+// ShardExists returns true if the shard is open in the store or if any of its
+// data or WAL directories remain on disk.
+func (s *Store) ShardExists(id uint64) bool {
+	if s.Shard(id) != nil {
+		return true
+	}
+
+	name := strconv.FormatUint(id, 10)
+	for _, dir := range []string{s.path, s.EngineOptions.Config.WALDir} {
+		if dir == "" {
+			continue
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*", "*", name)); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteShard removes a shard from disk. ErrShardNotFound is returned if the
+// shard doesn't exist.
 func (s *Store) DeleteShard(shardID uint64) error {
 	sh := s.Shard(shardID)
 	if sh == nil {
-		return nil
+		return ErrShardNotFound
 	}
 
 	// Remove the shard from the database indexes before closing the shard.
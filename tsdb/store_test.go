@@ -137,6 +137,26 @@ func TestStore_DeleteShard(t *testing.T) {
 	}
 }
 
+// Ensure the store reports whether a shard still exists after deletion.
+func TestStore_ShardExists(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.CreateShard("db0", "rp0", 1, true); err != nil {
+		t.Fatal(err)
+	} else if !s.ShardExists(1) {
+		t.Fatal("expected shard to exist")
+	}
+
+	if err := s.DeleteShard(1); err != nil {
+		t.Fatal(err)
+	} else if s.ShardExists(1) {
+		t.Fatal("expected shard to be removed")
+	} else if err := s.DeleteShard(1); err != tsdb.ErrShardNotFound {
+		t.Fatalf("unexpected error deleting a missing shard: %v", err)
+	}
+}
+
 // Ensure the store can create a snapshot to a shard.
 func TestStore_CreateShardSnapShot(t *testing.T) {
 	s := MustOpenStore()